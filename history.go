@@ -2,17 +2,144 @@ package readline
 
 import (
 	"bufio"
+	"compress/flate"
+	"compress/gzip"
 	"container/list"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"hash/maphash"
+	"io"
 	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+type DedupMode int
+
+const (
+	// drop a command which is equal to the previous one
+	DedupConsecutive DedupMode = iota
+	// keep all commands
+	DedupNone
+	// drop all earlier commands which are equal to the new one, so a command
+	// run again moves to the end, like hist_ignore_all_dups of zsh.
+	// HistoryFile keeps the order of appending, it's deduplicated when loaded.
+	DedupGlobal
+)
+
+// CaseFold is the case policy of a history behavior
+type CaseFold int
+
+const (
+	// follow HistorySearchFold
+	CaseFoldDefault CaseFold = iota
+	// compare the commands case-sensitively
+	CaseSensitive
+	// compare the commands case-insensitively
+	CaseInsensitive
+)
+
+// fold reports whether to ignore the case, def is used for CaseFoldDefault
+func (c CaseFold) fold(def bool) bool {
+	switch c {
+	case CaseSensitive:
+		return false
+	case CaseInsensitive:
+		return true
+	}
+	return def
+}
+
+// ShrinkPolicy is how HistoryFile is trimmed when it's loaded with more commands
+// than HistoryFileLimit, e.g. after the limit is lowered
+type ShrinkPolicy int
+
+const (
+	// rewrite HistoryFile with the last commands only, the others are lost
+	ShrinkRewrite ShrinkPolicy = iota
+	// only trim the commands in memory, HistoryFile is left as is
+	ShrinkMemoryOnly
+	// append the trimmed commands to HistoryFile with the ".archive" suffix
+	// before rewriting it
+	ShrinkArchive
+)
+
+// HistoryEventKind is what's changed in history, see HistoryEvents
+type HistoryEventKind int
+
+const (
+	// a command is saved
+	HistoryAdded HistoryEventKind = iota
+	// the editing line or a recalled command is changed, it's not saved yet
+	HistoryEdited
+	// all the commands are removed
+	HistoryCleared
+	// a command is removed by HistoryLimit or deduplicating
+	HistoryEvicted
+	// something is wrong but history works anyway, Err tells what it is
+	HistoryWarning
+)
+
+// HistoryEvent is a change of history sent to HistoryEvents
+type HistoryEvent struct {
+	Kind HistoryEventKind
+	// a copy of the command, nil for HistoryCleared
+	Line []rune
+	// the number of the command, as shown by DumpHistory. it's 0 for the editing line.
+	Seq int
+	// the command is still in history, it's only reported by HistoryDryRun.
+	// they're sent even while loading HistoryFile.
+	DryRun bool
+	// the problem of HistoryWarning, e.g. ErrHistoryGarbage with the skipped line
+	Err error
+}
+
+// HistoryFormat is the encoding used by exporting and importing history
+type HistoryFormat int
+
+const (
+	// one command per line, same as HistoryFile
+	HistoryFormatText HistoryFormat = iota
+	// one json object per line, with the timestamp and the directory if there
+	// are. it's a way to seed history from another store, e.g. a database the
+	// committed commands are inserted into by OnHistoryCommit.
+	HistoryFormatJSON
+)
+
+type historyRecord struct {
+	Line string `json:"line"`
+	Time int64  `json:"time,omitempty"`
+	Dir  string `json:"dir,omitempty"`
+}
+
 type hisItem struct {
 	Source  []rune
 	Version int64
 	Tmp     []rune
+	Time    time.Time
+	// created in this session rather than loaded
+	Session bool
+	// loaded from a file other than HistoryFile, it's not written to HistoryFile
+	Foreign bool
+	// the working directory it's run in, by HistoryRecordDir
+	Dir string
+	// the 1-based number in history, 0 if not committed yet
+	Seq int
+	// it would be removed by Compact or deduplicating, see HistoryDryRun
+	Dropped bool
 }
 
 func (h *hisItem) Clean() {
@@ -21,131 +148,2598 @@ func (h *hisItem) Clean() {
 }
 
 type opHistory struct {
-	cfg        *Config
+	cfg *Config
+	// guards history, current and historyVer, it's taken before fdLock
+	lock       sync.RWMutex
 	history    *list.List
 	historyVer int64
 	current    *list.Element
 	fd         *os.File
 	fdLock     sync.Mutex
 	enable     bool
+
+	// the compressed HistoryFile has commands not saved yet
+	dirty     bool
+	rewriteAt time.Time
+
+	// HistoryFile is loaded, it's not loaded again by Init after Close
+	loaded bool
+	// HistoryFile is closed by Close, it's opened again by Init but not by SetEnabled
+	closed bool
+	// where HistoryFile is read up to, for Reload
+	readOffset int64
+	// the byte ranges of our commands written after readOffset, Reload skips them
+	ownWrites [][2]int64
+
+	// the buffered commands by HistoryFlushCount and HistoryFlushInterval
+	pending    []string
+	flushTimer *time.Timer
+	// the sidecar lines of pending, see HistorySidecar
+	pendingMeta []string
+	// the comment lines before the first command in HistoryFile, they're
+	// written back by rewriting, see HistoryCommentPrefix
+	header []string
+	// HistoryFile is escaped by HistoryMultiline, it begins with multilineMarker
+	multiline bool
+	// pairs the loading lines with the metadata, see HistorySidecar
+	sidecar *sidecarReader
+	// the metadata in the sidecar paired up to, Reload pairs the ones after it
+	sidecarPos int
+
+	// the last number given to a history item
+	seq int
+	// don't send HistoryEvents, e.g. while loading HistoryFile
+	silent bool
+	// collect the commands trimmed by loading into shrunk, see ShrinkArchive
+	shrinking bool
+	shrunk    []*hisItem
+	// HistorySearchFold as of the start of the incremental search, see foldFor
+	searchFold    bool
+	searchFoldSet bool
+	// the navigation order by HistoryOrderFunc, the editing line isn't in it.
+	// it's computed by Prev/Next on demand and dropped if history is changed.
+	order    []*list.Element
+	orderPos map[*list.Element]int
+	// the formatted commands evicted from memory but still kept in HistoryFile,
+	// the oldest first, see HistoryFileLimit
+	archive []*hisItem
+	// the items edited in historyVer, their Tmp is released by bumpVersion
+	edited []*hisItem
+
+	// guards the buffers reused by Suggest on each keystroke, the scores
+	// are indexed by the hash of the command
+	suggestLock    sync.Mutex
+	suggestIndex   map[uint64]int
+	suggestEntries []suggestEntry
+	suggestKey     []byte
+	suggestHash    maphash.Hash
 }
 
 func newOpHistory(cfg *Config) (o *opHistory) {
 	o = &opHistory{
 		cfg:     cfg,
 		history: list.New(),
-		enable:  true,
+		enable:  !cfg.DisableHistory,
+		// the items never edited have the Version 0
+		historyVer: 1,
 	}
 	return o
 }
 
+// Reset removes all the history entries in memory, HistoryFile is kept untouched
 func (o *opHistory) Reset() {
+	o.lock.Lock()
+	o.history = list.New()
+	o.archive = nil
+	o.bumpVersion()
+	// the sentinel keeps current valid for the next command
+	o.Push(nil)
+	o.emit(HistoryCleared, nil, 0)
+	o.lock.Unlock()
+}
+
+// Clear removes all the history entries and truncates the HistoryFile
+func (o *opHistory) Clear() (err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
 	o.history = list.New()
+	o.archive = nil
 	o.current = nil
+	o.bumpVersion()
+	o.Push(nil)
+	o.emit(HistoryCleared, nil, 0)
+
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	o.pending, o.pendingMeta = nil, nil
+	if o.cfg.HistoryReadOnly {
+		return ErrHistoryReadOnly
+	}
+	if o.fd != nil {
+		if e := o.fd.Truncate(0); e != nil {
+			err = &HistoryError{Op: "clear", Path: o.cfg.HistoryFile, Err: e}
+		}
+		o.header = nil
+		// the file starts over for Reload
+		o.readOffset, o.ownWrites = 0, nil
+		if o.cfg.HistorySidecar {
+			os.Remove(o.sidecarPath())
+			o.sidecarPos = 0
+		}
+	}
+	return
 }
 
+// IsHistoryClosed reports whether there's no HistoryFile open, it's also true for
+// the history kept in memory only
 func (o *opHistory) IsHistoryClosed() bool {
 	o.fdLock.Lock()
 	defer o.fdLock.Unlock()
 	return o.fd.Fd() == ^(uintptr(0))
 }
 
-func (o *opHistory) Init() {
-	if o.IsHistoryClosed() {
-		o.initHistory()
+func (o *opHistory) Init() error {
+	_, err := o.InitN()
+	return err
+}
+
+// InitN is Init reporting how many entries history has after loading, the
+// editing line isn't counted.
+func (o *opHistory) InitN() (int, error) {
+	o.fdLock.Lock()
+	o.closed = false
+	o.fdLock.Unlock()
+	err := o.init()
+	return o.Len(), err
+}
+
+// Len returns how many entries history has, the editing line isn't counted.
+// it's the ones in memory, HistoryFile may have more by HistoryFileLimit.
+func (o *opHistory) Len() int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	n := 0
+	o.walk(false, func(*hisItem) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func (o *opHistory) init() error {
+	if !o.enable || !o.IsHistoryClosed() {
+		return nil
+	}
+	if o.loaded {
+		// it's closed after loaded, the entries are already in memory
+		return o.reopen()
+	}
+	return o.initHistory()
+}
+
+// fileMode returns the permission of the created HistoryFile
+func (o *opHistory) fileMode() os.FileMode {
+	if o.cfg.HistoryFileMode != 0 {
+		return o.cfg.HistoryFileMode
+	}
+	return 0666
+}
+
+// openHistoryFile opens the HistoryFile for appending, or reading only by HistoryReadOnly
+func (o *opHistory) openHistoryFile(path string) (*os.File, error) {
+	if o.cfg.HistoryReadOnly {
+		return os.Open(path)
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, o.fileMode())
+}
+
+// reopen opens HistoryFile for saving without loading it
+func (o *opHistory) reopen() error {
+	if o.cfg.HistoryFile == "" {
+		return nil
+	}
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	f, err := o.openHistoryFile(o.cfg.HistoryFile)
+	if err != nil {
+		return &HistoryError{Op: "load", Path: o.cfg.HistoryFile, Err: err}
+	}
+	o.fd = f
+	if fi, err := f.Stat(); err == nil {
+		o.readOffset, o.ownWrites = fi.Size(), nil
+	}
+	return nil
+}
+
+// expandHistoryPath expands the leading ~ or ~user to the home directory and
+// the environment variables in path, like a shell does for $HISTFILE. The unknown
+// user is left as is.
+func expandHistoryPath(path string) string {
+	if !strings.HasPrefix(path, "~") {
+		return os.ExpandEnv(path)
+	}
+	i := strings.IndexAny(path, `/\`)
+	if i < 0 {
+		i = len(path)
+	}
+	var home string
+	if name := path[1:i]; name == "" {
+		home, _ = os.UserHomeDir()
+	} else if u, err := user.Lookup(name); err == nil {
+		home = u.HomeDir
+	}
+	if home == "" {
+		return os.ExpandEnv(path)
+	}
+	return home + os.ExpandEnv(path[i:])
+}
+
+func (o *opHistory) initHistory() error {
+	if o.cfg.HistoryFile != "" {
+		return o.historyUpdatePath(o.cfg.HistoryFile)
+	}
+	return nil
+}
+
+// only called by newOpHistory
+func (o *opHistory) historyUpdatePath(path string) (loadErr error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	// the loaded commands aren't changes of history
+	o.silent = true
+	o.shrinking = o.cfg.HistoryShrinkPolicy == ShrinkArchive
+	defer func() {
+		o.silent = false
+		o.shrinking = false
+		o.shrunk = nil
+	}()
+	// Init may be retried after failing to load HistoryFile, it starts over
+	// with the commands of this session kept after the loaded ones
+	var session []*hisItem
+	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+		if item := elem.Value.(*hisItem); item.Session && len(item.Source) > 0 {
+			session = append(session, item)
+		}
+	}
+	o.history, o.current = list.New(), nil
+	o.archive, o.header = nil, nil
+	finish := func() {
+		for _, item := range session {
+			// numbered after the loaded ones, they're in order for ByNumber
+			item.Seq = 0
+			o.number(item)
+			o.history.PushBack(item)
+		}
+		o.bumpVersion()
+		o.Push(nil)
+	}
+	f, err := o.openHistoryFile(path)
+	if err != nil && o.cfg.HistoryReadOnly && os.IsNotExist(err) {
+		// nothing to load
+		finish()
+		return nil
+	} else if err != nil {
+		// keep the history in memory only
+		finish()
+		if o.cfg.HistoryFallbackMemory {
+			return nil
+		}
+		return &HistoryError{Op: "load", Path: path, Err: err}
+	}
+	unlock := o.lockHistoryFile()
+	defer unlock()
+	var src io.Reader = f
+	if o.compressed() {
+		gz, err := gzip.NewReader(f)
+		if err == nil {
+			defer gz.Close()
+			src = gz
+		} else if err != io.EOF {
+			// don't clobber the file we can't read
+			f.Close()
+			finish()
+			if o.cfg.HistoryFallbackMemory {
+				return nil
+			}
+			return &HistoryError{Op: "load", Path: path, Err: err}
+		}
+	}
+	// the older commands come first
+	for _, extra := range o.cfg.HistoryExtraFiles {
+		o.loadReadOnly(extra, strings.HasSuffix(extra, ".gz"))
+	}
+	if o.cfg.HistoryLoadRotated {
+		for i := o.rotateCount(); i >= 1; i-- {
+			o.loadReadOnly(o.rotatedPath(i), o.compressed())
+		}
+	} else if o.cfg.HistoryMaxBytes > 0 {
+		// HistoryFile starts empty by rotating, the recent commands are in it
+		o.loadReadOnly(o.rotatedPath(1), o.compressed())
+	}
+	o.fd = f
+	if o.cfg.HistorySidecar {
+		o.sidecar = o.readSidecar()
+	}
+	total, dirty, err := o.loadFrom(src, loadFile, nil)
+	if o.sidecar != nil {
+		if !o.sidecar.synced() {
+			// rewrite it in sync
+			o.send(HistoryEvent{Kind: HistoryWarning, Err: ErrHistorySidecarSync})
+			dirty = true
+		}
+		o.sidecarPos = o.sidecar.pos
+		o.sidecar = nil
+	}
+	if err != nil && o.cfg.HistoryBestEffort && total > 0 && isTruncated(err) {
+		// keep what's read, and rewrite the file with them
+		dirty = true
+		loadErr = ErrHistoryTruncated
+	} else if err != nil {
+		// don't mix up the lines encrypted by different keys,
+		// nor clobber the file we can't read
+		f.Close()
+		o.fd = nil
+		loadErr = &HistoryError{Op: "load", Path: path, Err: err}
+	}
+	o.Compact()
+	if o.fd != nil {
+		o.loaded = true
+		limit := o.fileLimit()
+		overflow := limit != 0 && total > limit
+		keep := o.cfg.HistoryKeepFileOnLoad || o.cfg.HistoryIncAppend || o.cfg.HistoryReadOnly || o.cfg.HistoryDryRun ||
+			overflow && o.cfg.HistoryShrinkPolicy == ShrinkMemoryOnly
+		if (overflow || dirty) && !keep {
+			o.rewriteLocked()
+		}
+		if total == 0 && !o.multiline && o.escapesLines() && !o.compressed() &&
+			!o.cfg.HistoryReadOnly && !o.cfg.HistoryDryRun {
+			// no command is in the old encoding, so it's started over escaped.
+			// the marker goes with the first command if the file is empty.
+			o.multiline = true
+			if fi, err := o.fd.Stat(); err == nil && fi.Size() > 0 {
+				if err := writeFull(o.fd, []byte(multilineMarker+o.eol())); err != nil {
+					o.multiline = false
+				} else {
+					o.header = append(o.header, multilineMarker)
+				}
+			}
+		}
+		if fi, err := o.fd.Stat(); err == nil {
+			o.readOffset, o.ownWrites = fi.Size(), nil
+		}
+	}
+	finish()
+	return
+}
+
+// loadReadOnly loads the commands from a file other than HistoryFile,
+// they're never written back.
+func (o *opHistory) loadReadOnly(path string, compressed bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var src io.Reader = f
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return
+		}
+		defer gz.Close()
+		src = gz
+	}
+	o.loadFrom(src, loadForeign, nil)
+}
+
+// Load reads the commands in the format of HistoryFile from r, e.g. embedded in
+// the program, and adds them after the ones in history. They're in memory only,
+// not written to HistoryFile.
+func (o *opHistory) Load(r io.Reader) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.loadBefore(func() error {
+		_, _, err := o.loadFrom(r, loadForeign, nil)
+		return err
+	})
+}
+
+// loadBefore runs load with the editing line taken out, so the commands it pushes
+// go before it. The browsed command is kept unless it's gone by then.
+func (o *opHistory) loadBefore(load func() error) error {
+	var sentinel *list.Element
+	if back := o.history.Back(); back != nil && o.isSentinel(back) {
+		sentinel = back
+		o.history.Remove(back)
+	}
+	current := o.current
+	err := load()
+	// Push moves current, Compact moves it off the evicted ones
+	o.current = current
+	o.Compact()
+	current = o.current
+	if sentinel != nil {
+		o.current = o.history.PushBack(sentinel.Value)
+	} else {
+		o.Push(nil)
+	}
+	o.order = nil
+	// the browsed command may be dropped by deduplicating
+	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+		if elem == current {
+			o.current = elem
+			break
+		}
+	}
+	return err
+}
+
+// loadSource is what loadFrom reads
+type loadSource int
+
+const (
+	// HistoryFile from the start, with the header and the sidecar
+	loadFile loadSource = iota
+	// the commands saved into HistoryFile after it's loaded, e.g. by others
+	loadMore
+	// the commands imported into HistoryFile, like loadMore but they're
+	// escaped only if the source begins with multilineMarker
+	loadImport
+	// the commands never written back, e.g. HistoryExtraFiles
+	loadForeign
+)
+
+// loadFrom pushes the commands read from src, it returns the count of the lines
+// and whether the file should be rewritten. add is called with each item pushed
+// if it's not nil.
+func (o *opHistory) loadFrom(src io.Reader, from loadSource, add func(item *hisItem)) (total int, dirty bool, err error) {
+	r := bufio.NewReader(src)
+	var ts time.Time
+	var dir string
+	foreign := from == loadForeign
+	if from == loadFile {
+		o.header = nil
+	}
+	// the rest of HistoryFile is in the same encoding
+	multiline := from == loadMore && o.multiline
+	commands := false
+	for eof := false; !eof; total++ {
+		line, err := r.ReadString(o.delimiter())
+		if err == io.EOF {
+			// the last line may have no line ending
+			if line == "" {
+				break
+			}
+			eof = true
+		} else if err != nil {
+			return total, dirty, err
+		}
+		// ignore the empty line
+		line = o.trimLine(line)
+		if len(line) == 0 {
+			continue
+		}
+		if line == multilineMarker && !commands {
+			total--
+			multiline = true
+			if from == loadFile {
+				o.header = append(o.header, line)
+			}
+			continue
+		}
+		if t, ok := o.parseTimestamp(line); ok {
+			// the timestamp is not a command
+			total--
+			ts = t
+			continue
+		}
+		if d, ok, err := o.parseDir(line); err != nil {
+			return total, dirty, err
+		} else if ok {
+			total--
+			dir = d
+			continue
+		}
+		if o.isComment(line) {
+			total--
+			// the header is kept by rewriting, the others are dropped by it
+			if from == loadFile && !commands {
+				o.header = append(o.header, line)
+			}
+			continue
+		}
+		commands = true
+		if o.sidecar != nil && !foreign {
+			if meta, ok := o.sidecar.next(line); ok {
+				if ts, dir, err = o.parseMeta(meta); err != nil {
+					return total, dirty, err
+				}
+			}
+		}
+		cmd, err := o.decodeLine(line, multiline)
+		if err != nil {
+			return total, dirty, err
+		}
+		if o.cfg.HistorySkipGarbage && isGarbage(cmd) {
+			o.send(HistoryEvent{Kind: HistoryWarning, Line: cmd, Err: ErrHistoryGarbage})
+			dirty = true
+			continue
+		}
+		rs, keep := o.fitEntry(cmd)
+		if !keep || len(rs) != len(cmd) {
+			dirty = true
+		}
+		if !keep {
+			continue
+		}
+		if o.dedup(rs, nil) {
+			dirty = true
+		}
+		o.Push(rs)
+		// keep the memory bounded by a huge file, compacting in a batch. the
+		// dropped ones are kept by HistoryDryRun, so it's compacted once after all.
+		if o.limit() > 0 && !o.cfg.HistoryDryRun && o.history.Len() >= 2*o.limit() {
+			o.Compact()
+		}
+		item := o.current.Value.(*hisItem)
+		item.Time = ts
+		item.Session = false
+		item.Foreign = foreign
+		item.Dir = dir
+		ts, dir = time.Time{}, ""
+		if from == loadMore || from == loadImport {
+			// they're news to HistoryEvents, unlike the loaded HistoryFile
+			o.emit(HistoryAdded, item.Source, item.Seq)
+		}
+		if add != nil {
+			add(item)
+		}
+	}
+	if from == loadFile {
+		o.multiline = multiline
+		// rewrite it in the encoding by HistoryMultiline
+		if commands && multiline != o.escapesLines() {
+			dirty = true
+		}
+	}
+	return total, dirty, nil
+}
+
+// workingDir returns the directory the command is run in for HistoryRecordDir
+func (o *opHistory) workingDir() string {
+	if o.cfg.FuncGetDir != nil {
+		return o.cfg.FuncGetDir()
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+// dirPrefix begins the comment line written by HistoryRecordDir
+const dirPrefix = "#dir "
+
+// parseDir parses the `#dir /path` comment line written by HistoryRecordDir
+func (o *opHistory) parseDir(line string) (string, bool, error) {
+	if !o.cfg.HistoryRecordDir || !strings.HasPrefix(line, dirPrefix) {
+		return "", false, nil
+	}
+	dir := line[len(dirPrefix):]
+	if o.cfg.HistoryCipher != nil {
+		var err error
+		if dir, err = o.decrypt(dir); err != nil {
+			return "", false, err
+		}
+	}
+	return dir, true, nil
+}
+
+// isComment reports whether the line is a comment by HistoryCommentPrefix
+func (o *opHistory) isComment(line string) bool {
+	return o.cfg.HistoryCommentPrefix != "" && strings.HasPrefix(line, o.cfg.HistoryCommentPrefix)
+}
+
+// parseTimestamp parses the `#1700000000` comment line written by HistoryTimestamp
+func (o *opHistory) parseTimestamp(line string) (time.Time, bool) {
+	if !o.cfg.HistoryTimestamp || !strings.HasPrefix(line, "#") {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+var (
+	lineBreakReplacer  = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+	multilineEscaper   = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+	multilineUnescaper = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r")
+)
+
+// multilineMarker begins HistoryFile escaped by HistoryMultiline, so the `\n`
+// in the file written without it isn't taken for a newline
+const multilineMarker = "#readline:multiline"
+
+// escapesLines reports whether the commands are escaped by HistoryMultiline
+// when HistoryFile is written from scratch
+func (o *opHistory) escapesLines() bool {
+	return o.cfg.HistoryMultiline && !o.nulDelimited()
+}
+
+// decodeLine decodes the line read from HistoryFile, unescaping it if the
+// file begins with multilineMarker
+func (o *opHistory) decodeLine(line string, multiline bool) ([]rune, error) {
+	if o.cfg.HistoryCipher != nil {
+		var err error
+		if line, err = o.decrypt(line); err != nil {
+			return nil, err
+		}
+	}
+	if multiline {
+		line = multilineUnescaper.Replace(line)
+	}
+	return []rune(line), nil
+}
+
+var (
+	// ErrHistoryLoad is matched by errors.Is for the errors of loading HistoryFile
+	ErrHistoryLoad = errors.New("history: can't load HistoryFile")
+	// ErrHistoryAppend is matched by errors.Is for the errors of saving a command,
+	// or of clearing HistoryFile
+	ErrHistoryAppend = errors.New("history: can't save to HistoryFile")
+)
+
+// HistoryError is an error of loading or saving HistoryFile, the cause
+// is got by errors.Unwrap
+type HistoryError struct {
+	// "load", "append", "clear", "relocate" or "compact"
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *HistoryError) Error() string {
+	return "history: " + e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *HistoryError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrHistoryLoad or ErrHistoryAppend by Op
+func (e *HistoryError) Is(target error) bool {
+	switch target {
+	case ErrHistoryLoad:
+		return e.Op == "load"
+	case ErrHistoryAppend:
+		return e.Op == "append" || e.Op == "clear"
+	}
+	return false
+}
+
+// ErrHistoryReadOnly is returned by changing HistoryFile with HistoryReadOnly
+var ErrHistoryReadOnly = errors.New("history: HistoryFile is read-only")
+
+var ErrHistoryDecrypt = errors.New("history: can't decrypt the line, it's corrupted or the key is wrong")
+
+// ErrHistorySidecarSync is sent by HistoryWarning if the sidecar doesn't match
+// HistoryFile while loading, it's rewritten in sync then
+var ErrHistorySidecarSync = errors.New("history: the sidecar is out of sync with HistoryFile")
+
+// ErrHistoryGarbage is sent by HistoryWarning with the line of HistoryFile skipped
+// by HistorySkipGarbage
+var ErrHistoryGarbage = errors.New("history: skip the garbage line")
+
+// ErrHistoryTruncated is returned by loading a truncated HistoryFile with
+// HistoryBestEffort, the commands before the broken part are loaded anyway.
+// it isn't fatal, history works as usual, so NewEx and SetConfig return it
+// along with their results.
+var ErrHistoryTruncated = errors.New("history: HistoryFile is truncated, it's loaded partially")
+
+// isTruncated reports whether err is returned by reading a broken stream, e.g.
+// a compressed HistoryFile cut by a crash. such an error is only seen at the end
+// of the stream, unlike ErrHistoryDecrypt, the lines before it are fine.
+func isTruncated(err error) bool {
+	var corrupt flate.CorruptInputError
+	return err == io.ErrUnexpectedEOF || err == gzip.ErrChecksum || errors.As(err, &corrupt)
+}
+
+// randRead is rand.Read, it's replaced in the tests
+var randRead = rand.Read
+
+func (o *opHistory) encrypt(line string) (string, error) {
+	aead := o.cfg.HistoryCipher
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := randRead(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(line), nil)), nil
+}
+
+func (o *opHistory) decrypt(line string) (string, error) {
+	aead := o.cfg.HistoryCipher
+	data, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", ErrHistoryDecrypt
+	}
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return "", ErrHistoryDecrypt
+	}
+	return string(plain), nil
+}
+
+// eol is the line ending of HistoryFile, see HistoryLineEnding
+func (o *opHistory) eol() string {
+	if o.cfg.HistoryLineEnding == "" {
+		return "\n"
+	}
+	return o.cfg.HistoryLineEnding
+}
+
+// formatItem returns the item in the form of how it's stored in HistoryFile,
+// escaped by HistoryMultiline if multiline. it fails if the line can't be encrypted.
+func (o *opHistory) formatItem(item *hisItem, multiline bool) (string, error) {
+	eol := o.eol()
+	// a pasted multi-line command shouldn't be split into several ones
+	var line string
+	if o.nulDelimited() {
+		line = string(item.Source)
+	} else if multiline {
+		line = multilineEscaper.Replace(string(item.Source))
+	} else {
+		line = lineBreakReplacer.Replace(string(item.Source))
+	}
+	var err error
+	if o.cfg.HistoryCipher != nil {
+		if line, err = o.encrypt(line); err != nil {
+			return "", err
+		}
+	}
+	line += eol
+	if o.cfg.HistorySidecar {
+		// the metadata is in the sidecar, see formatMeta
+		return line, nil
+	}
+	if o.cfg.HistoryRecordDir && item.Dir != "" {
+		dir := lineBreakReplacer.Replace(item.Dir)
+		if o.cfg.HistoryCipher != nil {
+			if dir, err = o.encrypt(dir); err != nil {
+				return "", err
+			}
+		}
+		line = dirPrefix + dir + eol + line
+	}
+	if o.cfg.HistoryTimestamp && !item.Time.IsZero() {
+		line = "#" + strconv.FormatInt(item.Time.Unix(), 10) + eol + line
+	}
+	return line, nil
+}
+
+// sidecarMeta is the metadata of a command in the sidecar of HistoryFile, see
+// HistorySidecar. Sum is the checksum of the line in HistoryFile, for telling
+// whether they're still in sync.
+type sidecarMeta struct {
+	Sum  uint32 `json:"sum"`
+	Time int64  `json:"time,omitempty"`
+	Dir  string `json:"dir,omitempty"`
+}
+
+// sidecarPath is the file HistorySidecar writes the metadata to
+func (o *opHistory) sidecarPath() string {
+	return o.cfg.HistoryFile + ".meta"
+}
+
+// formatMeta returns the line of the item in the sidecar, line is how the item
+// is written to HistoryFile by formatItem.
+func (o *opHistory) formatMeta(item *hisItem, line string) (string, error) {
+	meta := sidecarMeta{Sum: crc32.ChecksumIEEE([]byte(o.trimLine(line)))}
+	if !item.Time.IsZero() {
+		meta.Time = item.Time.Unix()
+	}
+	if o.cfg.HistoryRecordDir && item.Dir != "" {
+		meta.Dir = item.Dir
+		if o.cfg.HistoryCipher != nil {
+			var err error
+			if meta.Dir, err = o.encrypt(meta.Dir); err != nil {
+				return "", err
+			}
+		}
+	}
+	data, _ := json.Marshal(meta)
+	return string(data) + "\n", nil
+}
+
+// parseMeta returns the time and directory in the metadata
+func (o *opHistory) parseMeta(meta sidecarMeta) (ts time.Time, dir string, err error) {
+	if meta.Time != 0 {
+		ts = time.Unix(meta.Time, 0)
+	}
+	dir = meta.Dir
+	if dir != "" && o.cfg.HistoryCipher != nil {
+		dir, err = o.decrypt(dir)
+	}
+	return
+}
+
+// sidecarReader pairs the lines loaded from HistoryFile with the metadata in
+// the sidecar. once they're out of sync, e.g. HistoryFile is written by bash,
+// the rest of the lines are loaded without the metadata.
+type sidecarReader struct {
+	metas  []sidecarMeta
+	pos    int
+	broken bool
+	// skip the metadata not paired instead of breaking, e.g. of our own
+	// commands skipped by Reload
+	lenient bool
+}
+
+// readSidecar reads the sidecar of HistoryFile, the missing one has no metadata
+func (o *opHistory) readSidecar() *sidecarReader {
+	r := &sidecarReader{}
+	f, err := os.Open(o.sidecarPath())
+	if err != nil {
+		return r
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var meta sidecarMeta
+		if err := dec.Decode(&meta); err != nil {
+			// the broken part can't be paired with anything
+			r.broken = err != io.EOF
+			return r
+		}
+		r.metas = append(r.metas, meta)
+	}
+}
+
+// next returns the metadata of the next line loaded from HistoryFile
+func (r *sidecarReader) next(line string) (sidecarMeta, bool) {
+	if r.lenient {
+		sum := crc32.ChecksumIEEE([]byte(line))
+		for i := r.pos; i < len(r.metas); i++ {
+			if r.metas[i].Sum == sum {
+				r.pos = i + 1
+				return r.metas[i], true
+			}
+		}
+		return sidecarMeta{}, false
+	}
+	if r.broken || r.pos >= len(r.metas) || r.metas[r.pos].Sum != crc32.ChecksumIEEE([]byte(line)) {
+		r.broken = true
+		return sidecarMeta{}, false
+	}
+	r.pos++
+	return r.metas[r.pos-1], true
+}
+
+// synced reports whether all the lines and metadata are paired
+func (r *sidecarReader) synced() bool {
+	return !r.broken && r.pos == len(r.metas)
+}
+
+// appendSidecar appends the lines of formatMeta to the sidecar
+func (o *opHistory) appendSidecar(data string) error {
+	f, err := os.OpenFile(o.sidecarPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, o.fileMode())
+	if err != nil {
+		return err
+	}
+	err = writeFull(f, []byte(data))
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// replaceSidecar replaces the sidecar with data like rewriteLocked does
+func (o *opHistory) replaceSidecar(data string) error {
+	fd, tmpFile, err := o.createTemp(o.sidecarPath())
+	if err != nil {
+		return err
+	}
+	err = writeFull(fd, []byte(data))
+	if err == nil && o.cfg.HistorySync {
+		err = fd.Sync()
+	}
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, o.sidecarPath())
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+	}
+	return err
+}
+
+// isBlank reports whether the line is empty or only has spaces, it's never
+// committed to history
+func isBlank(line []rune) bool {
+	for _, r := range line {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isGarbage reports whether the line looks corrupted, it has a NUL or more than
+// a quarter of the runes aren't printable, see HistorySkipGarbage
+func isGarbage(line []rune) bool {
+	bad := 0
+	for _, r := range line {
+		if r == 0 {
+			return true
+		}
+		if r == utf8.RuneError || (r != '\t' && !unicode.IsPrint(r)) {
+			bad++
+		}
+	}
+	return bad*4 > len(line)
+}
+
+// nulDelimited reports whether the lines in HistoryFile end with a NUL,
+// see HistoryLineEnding
+func (o *opHistory) nulDelimited() bool {
+	return o.cfg.HistoryLineEnding == "\x00"
+}
+
+// delimiter is the byte ending the lines in HistoryFile
+func (o *opHistory) delimiter() byte {
+	if o.nulDelimited() {
+		return 0
+	}
+	return '\n'
+}
+
+// trimLine strips the line read from HistoryFile, see HistoryNoTrim
+func (o *opHistory) trimLine(line string) string {
+	if o.nulDelimited() {
+		line = strings.TrimSuffix(line, "\x00")
+	}
+	if !o.cfg.HistoryNoTrim {
+		return strings.TrimSpace(line)
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r")
+}
+
+func (o *opHistory) equalLine(a, b []rune) bool {
+	if o.cfg.HistorySameLineFunc != nil {
+		return o.cfg.HistorySameLineFunc(a, b)
+	}
+	return equalFold(a, b, o.cfg.HistoryDedupFold.fold(o.cfg.HistorySearchFold))
+}
+
+// equalFold compares a and b, ignoring the case if fold
+func equalFold(a, b []rune, fold bool) bool {
+	if fold {
+		return runes.EqualFold(a, b)
+	}
+	return runes.Equal(a, b)
+}
+
+// dedup removes the items which are duplicated with s according to
+// HistoryDedup, except the skip one. It reports whether any item is removed.
+func (o *opHistory) dedup(s []rune, skip *list.Element) (removed bool) {
+	switch o.cfg.HistoryDedup {
+	case DedupConsecutive:
+		back := o.kept(o.history.Back())
+		if back != nil && back != skip && o.equalLine(s, back.Value.(*hisItem).Source) {
+			o.drop(back)
+			removed = true
+		}
+	case DedupGlobal:
+		for elem := o.history.Front(); elem != nil; {
+			next := elem.Next()
+			if elem != skip && !elem.Value.(*hisItem).Dropped && o.equalLine(s, elem.Value.(*hisItem).Source) {
+				o.drop(elem)
+				removed = true
+			}
+			elem = next
+		}
+	}
+	return
+}
+
+// kept returns elem or the one before it which isn't dropped by HistoryDryRun
+func (o *opHistory) kept(elem *list.Element) *list.Element {
+	for elem != nil && elem.Value.(*hisItem).Dropped {
+		elem = elem.Prev()
+	}
+	return elem
+}
+
+// drop removes elem from history, it's only reported by HistoryDryRun
+func (o *opHistory) drop(elem *list.Element) {
+	item := elem.Value.(*hisItem)
+	if o.cfg.HistoryDryRun {
+		item.Dropped = true
+		o.send(HistoryEvent{Kind: HistoryEvicted, Line: runes.Copy(item.Source), Seq: item.Seq, DryRun: true})
+		return
+	}
+	o.history.Remove(elem)
+	o.order = nil
+	o.emitItem(HistoryEvicted, elem)
+}
+
+// fitEntry applies HistoryMaxEntryBytes to the line, it returns false
+// if the line should be dropped.
+func (o *opHistory) fitEntry(line []rune) ([]rune, bool) {
+	max := o.cfg.HistoryMaxEntryBytes
+	if max <= 0 || len(line) <= max {
+		return line, true
+	}
+	if !o.cfg.HistoryTruncateOversize {
+		return nil, false
+	}
+	return append(runes.Copy(line[:max-1]), '…'), true
+}
+
+// shouldIgnore reports whether the committed line should not be saved,
+// by HistoryIgnoreSpace or any pattern in HistoryIgnore
+func (o *opHistory) shouldIgnore(line []rune) bool {
+	if o.cfg.HistoryIgnoreSpace && len(line) > 0 && unicode.IsSpace(line[0]) {
+		return true
+	}
+	if len(o.cfg.HistoryIgnore) == 0 {
+		return false
+	}
+	fold := o.cfg.HistoryIgnoreFold.fold(o.cfg.HistorySearchFold)
+	// path.Match won't let '*' cross the '/', hide it from path.Match
+	s := strings.Replace(string(line), "/", "\x00", -1)
+	// folded like EqualRuneFold, path.Match can't ignore the case
+	if fold {
+		s = strings.Map(runes.FoldRune, s)
+	}
+	for _, pattern := range o.cfg.HistoryIgnore {
+		pattern = strings.Replace(pattern, "/", "\x00", -1)
+		if fold {
+			pattern = strings.Map(runes.FoldRune, pattern)
+		}
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isSentinel reports whether elem is the empty item pushed for the next command
+func (o *opHistory) isSentinel(elem *list.Element) bool {
+	return elem == o.history.Back() && len(elem.Value.(*hisItem).Source) == 0
+}
+
+// ByNumber returns the command numbered n, like !n of csh. The numbers stay the
+// same when the older commands are evicted, it returns false for those.
+func (o *opHistory) ByNumber(n int) ([]rune, bool) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	for elem := o.history.Back(); elem != nil; elem = elem.Prev() {
+		item := elem.Value.(*hisItem)
+		if item.Seq == n && n > 0 {
+			return runes.Copy(item.Source), true
+		}
+		if item.Seq != 0 && item.Seq < n {
+			// they're numbered in order
+			break
+		}
+	}
+	return nil, false
+}
+
+// History returns a copy of the history entries, from the oldest to the newest
+func (o *opHistory) History() [][]rune {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	ret := make([][]rune, 0, o.history.Len())
+	o.walk(false, func(item *hisItem) bool {
+		ret = append(ret, runes.Copy(item.Source))
+		return true
+	})
+	return ret
+}
+
+// HistoryEntry is a command in history with its metadata
+type HistoryEntry struct {
+	Line []rune
+	// zero if it's unknown, see HistoryTimestamp
+	Time time.Time
+	// empty if it's unknown, see HistoryRecordDir
+	Dir string
+}
+
+// Entries returns a copy of the history entries, from the oldest to the newest
+func (o *opHistory) Entries() []HistoryEntry {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	ret := make([]HistoryEntry, 0, o.history.Len())
+	o.walk(false, func(item *hisItem) bool {
+		ret = append(ret, HistoryEntry{Line: runes.Copy(item.Source), Time: item.Time, Dir: item.Dir})
+		return true
+	})
+	return ret
+}
+
+// HistoryStats is the statistics of history, see Stats
+type HistoryStats struct {
+	Total  int
+	Unique int
+	// the most frequent commands, ties are broken by the more recent one
+	Top []HistoryCount
+}
+
+// HistoryCount is a command with the times it's in history
+type HistoryCount struct {
+	Line  []rune
+	Count int
+}
+
+// Stats counts the commands in history, with up to top most frequent ones,
+// all of them if top <= 0
+func (o *opHistory) Stats(top int) HistoryStats {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	var stats HistoryStats
+	index := make(map[string]int)
+	var counts []HistoryCount
+	// newest first, so the earlier one in counts is the more recent
+	o.walk(true, func(item *hisItem) bool {
+		stats.Total++
+		key := string(item.Source)
+		if i, ok := index[key]; ok {
+			counts[i].Count++
+			return true
+		}
+		index[key] = len(counts)
+		counts = append(counts, HistoryCount{Line: runes.Copy(item.Source), Count: 1})
+		return true
+	})
+	stats.Unique = len(counts)
+	sort.SliceStable(counts, func(i, j int) bool {
+		return counts[i].Count > counts[j].Count
+	})
+	if top > 0 && top < len(counts) {
+		counts = counts[:top]
+	}
+	stats.Top = counts
+	return stats
+}
+
+// MergeHistoryFiles loads the history files written with HistoryTimestamp, e.g. from
+// several hosts, and merges them by the time. The duplicated commands are kept
+// the latest one, and the most recent limit ones are returned, all if limit <= 0.
+// The commands without a timestamp take the time of the previous one in the file,
+// so they keep their order.
+func MergeHistoryFiles(paths []string, limit int) ([]HistoryEntry, error) {
+	o := newOpHistory(&Config{HistoryTimestamp: true})
+	type entry struct {
+		HistoryEntry
+		at time.Time
+	}
+	var entries []entry
+	for _, path := range paths {
+		items, err := o.readHistoryItems(path)
+		if err != nil {
+			return nil, err
+		}
+		var at time.Time
+		for _, item := range items {
+			if !item.Time.IsZero() {
+				at = item.Time
+			}
+			entries = append(entries, entry{HistoryEntry{Line: item.Source, Time: item.Time}, at})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].at.Before(entries[j].at)
+	})
+
+	// walk from the newest to keep the latest one of the duplicated
+	seen := make(map[string]bool)
+	var ret []HistoryEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		if limit > 0 && len(ret) >= limit {
+			break
+		}
+		if line := string(entries[i].Line); !seen[line] {
+			seen[line] = true
+			ret = append(ret, entries[i].HistoryEntry)
+		}
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret, nil
+}
+
+// readHistoryItems reads all the commands of a history file, which is decompressed
+// if its name ends with ".gz"
+func (o *opHistory) readHistoryItems(path string) ([]*hisItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, &HistoryError{Op: "load", Path: path, Err: err}
+	}
+	defer f.Close()
+	var src io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, &HistoryError{Op: "load", Path: path, Err: err}
+		}
+		defer gz.Close()
+		src = gz
+	}
+	var items []*hisItem
+	_, _, err = o.loadFrom(src, loadForeign, func(item *hisItem) {
+		items = append(items, item)
+	})
+	if err != nil {
+		return nil, &HistoryError{Op: "load", Path: path, Err: err}
+	}
+	return items, nil
+}
+
+// Walk calls fn with a copy of each history entry, from the newest to the oldest
+// if newestFirst is set, until fn returns false. fn is called with history
+// locked, so it mustn't change history.
+func (o *opHistory) Walk(newestFirst bool, fn func(line []rune) bool) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	o.walk(newestFirst, func(item *hisItem) bool {
+		return fn(runes.Copy(item.Source))
+	})
+}
+
+// walk calls fn with each history entry except the sentinel, until fn returns false
+func (o *opHistory) walk(newestFirst bool, fn func(item *hisItem) bool) {
+	if !newestFirst {
+		for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+			if o.isSentinel(elem) || !fn(elem.Value.(*hisItem)) {
+				return
+			}
+		}
+		return
+	}
+	elem := o.history.Back()
+	if elem != nil && o.isSentinel(elem) {
+		elem = elem.Prev()
+	}
+	for ; elem != nil; elem = elem.Prev() {
+		if !fn(elem.Value.(*hisItem)) {
+			return
+		}
+	}
+}
+
+// Export writes all the history entries to w, from the oldest to the newest
+func (o *opHistory) Export(w io.Writer, format HistoryFormat) error {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	multiline := o.escapesLines()
+	if format != HistoryFormatJSON && multiline {
+		buf.WriteString(multilineMarker + o.eol())
+	}
+	var err error
+	o.walk(false, func(item *hisItem) bool {
+		if format != HistoryFormatJSON {
+			var line string
+			line, err = o.formatItem(item, multiline)
+			buf.WriteString(line)
+			return err == nil
+		}
+		r := historyRecord{Line: string(item.Source), Dir: item.Dir}
+		if !item.Time.IsZero() {
+			r.Time = item.Time.Unix()
+		}
+		err = enc.Encode(r)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// Suggest returns the most frecent command starting with prefix, for the
+// autosuggestion. Each occurrence of a command is weighted by its position
+// from the oldest one, so it prefers the frequent and recent one. a tie goes
+// to the one used most recently.
+func (o *opHistory) Suggest(prefix []rune) []rune {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	if len(prefix) == 0 {
+		return nil
+	}
+	o.suggestLock.Lock()
+	defer o.suggestLock.Unlock()
+	if o.suggestIndex == nil {
+		o.suggestIndex = make(map[uint64]int)
+	}
+	index := o.suggestIndex
+	for key := range index {
+		delete(index, key)
+	}
+	defer func() {
+		// don't keep the lines alive
+		for i := range o.suggestEntries {
+			o.suggestEntries[i].line = nil
+		}
+		o.suggestEntries = o.suggestEntries[:0]
+	}()
+	var best []rune
+	bestIdx, bestScore, second := -1, 0, 0
+	weight := o.history.Len()
+	if back := o.history.Back(); back != nil && o.isSentinel(back) {
+		weight--
+	}
+	o.walk(true, func(item *hisItem) bool {
+		weight--
+		line := item.Source
+		if len(line) > len(prefix) && o.hasPrefix(line, prefix) {
+			idx := o.suggestEntry(line)
+			o.suggestEntries[idx].score += weight + 1
+			score := o.suggestEntries[idx].score
+			switch {
+			case idx == bestIdx:
+				bestScore = score
+			case score > bestScore || score == bestScore && idx < bestIdx:
+				// a tie goes to the one used most recently, the entries are
+				// added in the order of their newest occurrences
+				second = bestScore
+				best, bestIdx, bestScore = line, idx, score
+			case score > second:
+				second = score
+			}
+		}
+		// stop once no other command can reach the best one by the weights
+		// left, which are weight, weight-1, ..., 1
+		return best == nil || int64(second)+int64(weight)*int64(weight+1)/2 >= int64(bestScore)
+	})
+	if best == nil {
+		return nil
+	}
+	return runes.Copy(best)
+}
+
+// suggestEntry scores a command for Suggest
+type suggestEntry struct {
+	line  []rune
+	score int
+	// the next entry with the same hash, or -1
+	next int
+}
+
+// suggestEntry returns the index of the entry of line in suggestEntries,
+// it's added if not found. suggestLock must be held.
+func (o *opHistory) suggestEntry(line []rune) int {
+	o.suggestKey = appendRunes(o.suggestKey[:0], line)
+	o.suggestHash.Reset()
+	o.suggestHash.Write(o.suggestKey)
+	key := o.suggestHash.Sum64()
+	head, ok := o.suggestIndex[key]
+	if !ok {
+		head = -1
+	}
+	for idx := head; idx >= 0; idx = o.suggestEntries[idx].next {
+		if runes.Equal(o.suggestEntries[idx].line, line) {
+			return idx
+		}
+	}
+	o.suggestEntries = append(o.suggestEntries, suggestEntry{line: line, next: head})
+	o.suggestIndex[key] = len(o.suggestEntries) - 1
+	return len(o.suggestEntries) - 1
+}
+
+// appendRunes appends the UTF-8 encoding of r to buf
+func appendRunes(buf []byte, r []rune) []byte {
+	var enc [utf8.UTFMax]byte
+	for _, c := range r {
+		n := utf8.EncodeRune(enc[:], c)
+		buf = append(buf, enc[:n]...)
+	}
+	return buf
+}
+
+// Dump writes the history entries to w one per line, from the oldest to the
+// newest. If withNumbers, each line is prefixed with its number like bash does.
+func (o *opHistory) Dump(w io.Writer, withNumbers bool) error {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	buf := bufio.NewWriter(w)
+	o.walk(false, func(item *hisItem) bool {
+		if withNumbers {
+			fmt.Fprintf(buf, "%5d  ", item.Seq)
+		}
+		buf.WriteString(string(item.Source))
+		buf.WriteByte('\n')
+		return true
+	})
+	return buf.Flush()
+}
+
+// Import reads the entries written by Export and saves them into history.
+// They are inserted before the command being edited, which is kept untouched.
+func (o *opHistory) Import(r io.Reader, format HistoryFormat) error {
+	if format != HistoryFormatJSON {
+		return o.importText(r)
+	}
+	var items []*hisItem
+	dec := json.NewDecoder(r)
+	for {
+		var rec historyRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(rec.Line) == 0 {
+			continue
+		}
+		item := &hisItem{Source: []rune(rec.Line), Dir: rec.Dir}
+		if rec.Time != 0 {
+			item.Time = time.Unix(rec.Time, 0)
+		}
+		items = append(items, item)
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	var err error
+	for _, item := range items {
+		o.insertItem(item)
+		if o.fd != nil && err == nil && !o.cfg.HistoryReadOnly {
+			if e := o.appendLocked(item); e != nil {
+				err = &HistoryError{Op: "append", Path: o.cfg.HistoryFile, Err: e}
+			}
+		}
+	}
+	o.Compact()
+	return err
+}
+
+// importText imports the lines in the format of HistoryFile, they're loaded like
+// the ones in HistoryFile and appended to it
+func (o *opHistory) importText(r io.Reader) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	var items []*hisItem
+	err := o.loadBefore(func() error {
+		_, _, err := o.loadFrom(r, loadImport, func(item *hisItem) {
+			items = append(items, item)
+		})
+		return err
+	})
+	// the ones before the broken line are imported anyway
+	if len(items) == 0 || o.fd == nil || o.cfg.HistoryReadOnly {
+		return err
+	}
+	if e := o.appendLocked(items...); e != nil && err == nil {
+		err = &HistoryError{Op: "append", Path: o.cfg.HistoryFile, Err: e}
+	}
+	return err
+}
+
+// PushAll inserts the lines before the command being edited at once, e.g. to seed
+// history at startup. Unlike Add, the lines aren't deduplicated nor ignored.
+// They're appended to HistoryFile in one write if save is set.
+func (o *opHistory) PushAll(lines [][]rune, save bool) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	var items []*hisItem
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		item := &hisItem{Source: runes.Copy(line)}
+		o.insertItem(item)
+		if save {
+			items = append(items, item)
+		}
+	}
+	o.Compact()
+	if len(items) == 0 || o.fd == nil || o.cfg.HistoryReadOnly {
+		return nil
+	}
+	if err := o.appendLocked(items...); err != nil {
+		return &HistoryError{Op: "append", Path: o.cfg.HistoryFile, Err: err}
+	}
+	return nil
+}
+
+// insertItem inserts the item before the command being edited
+func (o *opHistory) insertItem(item *hisItem) {
+	o.number(item)
+	o.order = nil
+	if back := o.history.Back(); back != nil && o.isSentinel(back) {
+		o.history.InsertBefore(item, back)
+	} else {
+		o.history.PushBack(item)
+	}
+	o.emit(HistoryAdded, item.Source, item.Seq)
+}
+
+// ownWrite reports whether the line at offset of HistoryFile is written by us
+func (o *opHistory) ownWrite(offset int64) bool {
+	for _, w := range o.ownWrites {
+		if w[0] <= offset && offset < w[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload merges the commands appended to HistoryFile by other processes
+// since it's loaded.
+func (o *opHistory) Reload() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	if o.cfg.HistoryFile == "" || o.fd == nil || o.compressed() {
+		return nil
+	}
+	if err := o.reloadLocked(); err != nil {
+		return &HistoryError{Op: "load", Path: o.cfg.HistoryFile, Err: err}
+	}
+	return nil
+}
+
+// reloadLocked is Reload with history and HistoryFile locked
+func (o *opHistory) reloadLocked() error {
+	f, err := os.Open(o.cfg.HistoryFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() <= o.readOffset {
+		// the file is rewritten by others, just keep up with it
+		o.readOffset, o.ownWrites = fi.Size(), nil
+		return nil
+	}
+	if _, err := f.Seek(o.readOffset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var lines strings.Builder
+	r := bufio.NewReader(f)
+	for {
+		// the incomplete line may be still being written
+		line, err := r.ReadString(o.delimiter())
+		if err != nil {
+			break
+		}
+		start := o.readOffset
+		o.readOffset += int64(len(line))
+		if !o.ownWrite(start) {
+			lines.WriteString(line)
+		}
+	}
+	// the ones read are done
+	for len(o.ownWrites) > 0 && o.ownWrites[0][1] <= o.readOffset {
+		o.ownWrites = o.ownWrites[1:]
+	}
+	if o.cfg.HistorySidecar {
+		// the commands by others come with their metadata, ours are skipped
+		r := o.readSidecar()
+		r.lenient = true
+		if o.sidecarPos < len(r.metas) {
+			r.pos = o.sidecarPos
+		} else {
+			r.pos = len(r.metas)
+		}
+		o.sidecar = r
+		defer func() {
+			o.sidecarPos = r.pos
+			o.sidecar = nil
+		}()
+	}
+	return o.loadBefore(func() error {
+		_, _, err := o.loadFrom(strings.NewReader(lines.String()), loadMore, nil)
+		return err
+	})
+}
+
+// Trim is Compact for the embedder, e.g. at a checkpoint after a command is done
+func (o *opHistory) Trim() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.Compact()
+}
+
+// CompactFile trims history like Trim and rewrites HistoryFile with it right away,
+// so it's deduplicated and trimmed to HistoryFileLimit. It's a no-op if there's
+// no HistoryFile to write, e.g. with HistoryReadOnly or HistoryDryRun.
+func (o *opHistory) CompactFile() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.Compact()
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	if o.fd == nil || o.cfg.HistoryReadOnly || o.cfg.HistoryDryRun {
+		return nil
+	}
+	unlock := o.lockHistoryFile()
+	defer unlock()
+	if err := o.rewriteLocked(); err != nil {
+		return &HistoryError{Op: "compact", Path: o.cfg.HistoryFile, Err: err}
+	}
+	return nil
+}
+
+// Compact keeps at most HistoryLimit entries, the sentinel for the next command
+// isn't counted. HistoryLimit 0 means no limit, which is only seen if Config.Init
+// isn't called, it's 500 by default then. see HistoryNoLimit for the Config.
+func (o *opHistory) Compact() {
+	if o.limit() == 0 {
+		return
+	}
+	if o.cfg.HistoryDryRun {
+		o.dryCompact()
+		return
+	}
+	n := o.history.Len() - o.limit()
+	if back := o.history.Back(); back != nil && o.isSentinel(back) {
+		n--
+	}
+	if n > o.history.Len() {
+		n = o.history.Len()
+	}
+	archive := o.limit() > 0 && o.fileLimit() > o.limit()
+	evicted := false
+	for ; n > 0; n-- {
+		front := o.history.Front()
+		evicted = evicted || front == o.current
+		o.history.Remove(front)
+		o.order = nil
+		o.emitItem(HistoryEvicted, front)
+		if item := front.Value.(*hisItem); len(item.Source) > 0 && !item.Foreign {
+			if archive {
+				o.archive = append(o.archive, item)
+			} else if o.shrinking {
+				o.shrunk = append(o.shrunk, item)
+			}
+		}
+	}
+	if evicted {
+		// don't leave current on a removed element
+		o.current = o.history.Front()
+	}
+	if max := o.fileLimit() - o.limit(); archive && len(o.archive) > max {
+		if o.shrinking {
+			o.shrunk = append(o.shrunk, o.archive[:len(o.archive)-max]...)
+		}
+		o.archive = append(o.archive[:0], o.archive[len(o.archive)-max:]...)
+	}
+}
+
+// dryCompact reports the items Compact would remove, see HistoryDryRun
+func (o *opHistory) dryCompact() {
+	n := -o.limit()
+	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+		if !elem.Value.(*hisItem).Dropped && !o.isSentinel(elem) {
+			n++
+		}
+	}
+	for elem := o.history.Front(); elem != nil && n > 0; elem = elem.Next() {
+		if !elem.Value.(*hisItem).Dropped && !o.isSentinel(elem) {
+			o.drop(elem)
+			n--
+		}
+	}
+}
+
+// writeArchive appends the items to HistoryFile with the ".archive" suffix,
+// see ShrinkArchive
+func (o *opHistory) writeArchive(items []*hisItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(o.cfg.HistoryFile+".archive", os.O_APPEND|os.O_CREATE|os.O_WRONLY, o.fileMode())
+	if err != nil {
+		return err
+	}
+	var buf strings.Builder
+	multiline := o.escapesLines()
+	if fi, err := f.Stat(); err == nil && fi.Size() == 0 && multiline {
+		buf.WriteString(multilineMarker + o.eol())
+	}
+	for _, item := range items {
+		line, err := o.formatItem(item, multiline)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		buf.WriteString(line)
+	}
+	err = writeFull(f, []byte(buf.String()))
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// createTemp creates a file next to path for rewriting it, the name is unique
+// so the processes sharing HistoryFile don't write to the same one.
+func (o *opHistory) createTemp(path string) (*os.File, string, error) {
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s.%d.%d.tmp", path, os.Getpid(), time.Now().UnixNano()+int64(i))
+		fd, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, o.fileMode())
+		if os.IsExist(err) && i < 100 {
+			continue
+		}
+		return fd, name, err
+	}
+}
+
+// limit is the most commands kept in memory, 0 means no limit. it's negative
+// to disable history, see HistoryLimit
+func (o *opHistory) limit() int {
+	if o.cfg.HistoryNoLimit {
+		return 0
+	}
+	return o.cfg.HistoryLimit
+}
+
+// fileLimit is the most commands kept in HistoryFile, see HistoryFileLimit
+func (o *opHistory) fileLimit() int {
+	if o.cfg.HistoryFileLimit != 0 {
+		return o.cfg.HistoryFileLimit
+	}
+	return o.limit()
+}
+
+func (o *opHistory) Rewrite() {
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	o.rewriteLocked()
+}
+
+// rewriteLocked writes the entries to a temporary file and replaces HistoryFile
+// with it, HistoryFile is kept as is on failure.
+func (o *opHistory) rewriteLocked() error {
+	if o.cfg.HistoryFile == "" || o.cfg.HistoryReadOnly {
+		return nil
+	}
+
+	fd, tmpFile, err := o.createTemp(o.cfg.HistoryFile)
+	if err != nil {
+		return err
+	}
+	if o.cfg.HistoryFileMode != 0 {
+		// not masked by umask, it replaces HistoryFile
+		fd.Chmod(o.cfg.HistoryFileMode)
+	}
+
+	var dst io.Writer = fd
+	var gz *gzip.Writer
+	if o.compressed() {
+		gz = gzip.NewWriter(fd)
+		dst = gz
+	}
+	var items []*hisItem
+	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+		item := elem.Value.(*hisItem)
+		if isBlank(item.Source) || item.Foreign {
+			continue
+		}
+		items = append(items, item)
+	}
+	var dropped []*hisItem
+	if limit := o.fileLimit(); limit > 0 {
+		if len(items) >= limit {
+			dropped = append(append(dropped, o.archive...), items[:len(items)-limit]...)
+			items = items[len(items)-limit:]
+			o.archive = nil
+		} else if n := limit - len(items); len(o.archive) > n {
+			dropped = append(dropped, o.archive[:len(o.archive)-n]...)
+			o.archive = o.archive[len(o.archive)-n:]
+		}
+	}
+	items = append(o.archive[:len(o.archive):len(o.archive)], items...)
+	if o.shrinking {
+		// the trimmed commands are kept elsewhere before HistoryFile is replaced
+		if err := o.writeArchive(append(o.shrunk, dropped...)); err != nil {
+			fd.Close()
+			os.Remove(tmpFile)
+			return err
+		}
+		o.shrunk = nil
+	}
+	buf := bufio.NewWriter(dst)
+	// it's written in the encoding by HistoryMultiline from now on
+	multiline := o.escapesLines()
+	var header []string
+	if multiline {
+		header = append(header, multilineMarker)
+	}
+	for _, line := range o.header {
+		if line != multilineMarker {
+			header = append(header, line)
+		}
+	}
+	for _, line := range header {
+		buf.WriteString(line + o.eol())
+	}
+	var meta strings.Builder
+	for _, item := range items {
+		var line, m string
+		if line, err = o.formatItem(item, multiline); err == nil && o.cfg.HistorySidecar {
+			m, err = o.formatMeta(item, line)
+		}
+		if err != nil {
+			fd.Close()
+			os.Remove(tmpFile)
+			return err
+		}
+		buf.WriteString(line)
+		meta.WriteString(m)
+	}
+	err = buf.Flush()
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil && o.cfg.HistorySync {
+		err = fd.Sync()
+	}
+	if err == nil && o.cfg.HistorySidecar {
+		// it's out of sync if HistoryFile isn't replaced after it, which is
+		// seen by loading
+		err = o.replaceSidecar(meta.String())
+	}
+	if err == nil {
+		// replace history file
+		err = os.Rename(tmpFile, o.cfg.HistoryFile)
+	}
+	if err != nil {
+		fd.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+
+	if o.fd != nil {
+		o.fd.Close()
+	}
+	// fd is write only, just satisfy what we need.
+	o.fd = fd
+	o.header, o.multiline = header, multiline
+	o.dirty = false
+	o.rewriteAt = time.Now()
+	// Reload starts after the rewritten file
+	o.readOffset, o.ownWrites = 0, nil
+	if fi, err := fd.Stat(); err == nil {
+		o.readOffset = fi.Size()
+	}
+	// the pending commands are all in the rewritten file
+	o.pending, o.pendingMeta = nil, nil
+	o.sidecarPos = len(items)
+	return nil
+}
+
+// compressed reports whether HistoryFile is stored with gzip
+func (o *opHistory) compressed() bool {
+	return o.cfg.HistoryCompress || strings.HasSuffix(o.cfg.HistoryFile, ".gz")
+}
+
+// lockHistoryFile takes the cross-process lock for HistoryFile if HistoryFileLock is set,
+// the returned function releases it.
+func (o *opHistory) lockHistoryFile() (unlock func()) {
+	unlock = func() {}
+	// the lock file isn't created for reading only
+	if !o.cfg.HistoryFileLock || o.cfg.HistoryFile == "" || o.cfg.HistoryReadOnly {
+		return
+	}
+	f, err := os.OpenFile(o.cfg.HistoryFile+".lock", os.O_CREATE|os.O_RDWR, o.fileMode())
+	if err != nil {
+		return
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}
+}
+
+// appendLocked appends the items to HistoryFile, with their metadata to the
+// sidecar by HistorySidecar
+func (o *opHistory) appendLocked(items ...*hisItem) error {
+	if o.cfg.HistoryReadOnly {
+		return ErrHistoryReadOnly
+	}
+	// the blank commands are never saved, whoever adds them
+	var saved []*hisItem
+	for _, item := range items {
+		if !isBlank(item.Source) {
+			saved = append(saved, item)
+		}
+	}
+	if items = saved; len(items) == 0 {
+		return nil
+	}
+	if o.compressed() {
+		unlock := o.lockHistoryFile()
+		defer unlock()
+		// gzip can't be appended, rewrite the whole file instead
+		o.dirty = true
+		if time.Since(o.rewriteAt) >= o.cfg.HistoryCompressInterval {
+			o.rewriteLocked()
+		}
+		return nil
+	}
+	var line, meta string
+	for _, item := range items {
+		l, err := o.formatItem(item, o.multiline)
+		if err != nil {
+			return err
+		}
+		line += l
+		if o.cfg.HistorySidecar {
+			m, err := o.formatMeta(item, l)
+			if err != nil {
+				return err
+			}
+			meta += m
+		}
+	}
+	if o.cfg.HistoryIncAppend || o.cfg.HistoryFlushCount <= 0 && o.cfg.HistoryFlushInterval <= 0 {
+		return o.writeLocked(line, meta)
+	}
+
+	o.pending = append(o.pending, line)
+	o.pendingMeta = append(o.pendingMeta, meta)
+	if o.cfg.HistoryFlushCount > 0 && len(o.pending) >= o.cfg.HistoryFlushCount {
+		return o.flushLocked()
+	}
+	if o.cfg.HistoryFlushInterval > 0 {
+		if o.flushTimer == nil {
+			o.flushTimer = time.AfterFunc(o.cfg.HistoryFlushInterval, func() {
+				o.fdLock.Lock()
+				defer o.fdLock.Unlock()
+				// nobody is waiting for it, so it's reported by HistoryWarning
+				if err := o.flushLocked(); err != nil {
+					err = &HistoryError{Op: "append", Path: o.cfg.HistoryFile, Err: err}
+					o.send(HistoryEvent{Kind: HistoryWarning, Err: err})
+				}
+			})
+		} else {
+			o.flushTimer.Reset(o.cfg.HistoryFlushInterval)
+		}
+	}
+	return nil
+}
+
+// flushLocked writes the pending commands to HistoryFile
+func (o *opHistory) flushLocked() error {
+	if o.flushTimer != nil {
+		o.flushTimer.Stop()
+	}
+	if len(o.pending) == 0 || o.fd == nil {
+		return nil
+	}
+	data, meta := strings.Join(o.pending, ""), strings.Join(o.pendingMeta, "")
+	o.pending, o.pendingMeta = nil, nil
+	return o.writeLocked(data, meta)
+}
+
+// writeLocked appends data to HistoryFile, and meta to the sidecar if it's not empty
+func (o *opHistory) writeLocked(data, meta string) error {
+	unlock := o.lockHistoryFile()
+	defer unlock()
+	if o.cfg.HistoryReopenOnMissing {
+		if err := o.reopenIfMissing(); err != nil {
+			return err
+		}
+	}
+	var size int64 = -1
+	if fi, err := o.fd.Stat(); err == nil {
+		size = fi.Size()
+	}
+	if size == 0 && o.multiline {
+		// a new file, e.g. by rotating
+		data = multilineMarker + o.eol() + data
+		o.header = []string{multilineMarker}
+	}
+	if err := writeFull(o.fd, []byte(data)); err != nil {
+		return err
+	}
+	if meta != "" {
+		if err := o.appendSidecar(meta); err != nil {
+			return err
+		}
+	}
+	// skip our own command on Reload, it's not at readOffset if others have
+	// appended after the last read.
+	if size == o.readOffset {
+		o.readOffset += int64(len(data))
+	} else if size > o.readOffset {
+		o.ownWrites = append(o.ownWrites, [2]int64{size, size + int64(len(data))})
+	}
+	if o.cfg.HistorySync {
+		if err := o.fd.Sync(); err != nil {
+			return err
+		}
+	}
+	if o.cfg.HistoryMaxBytes > 0 && size+int64(len(data)) > o.cfg.HistoryMaxBytes {
+		return o.rotateLocked()
+	}
+	return nil
+}
+
+// reopenIfMissing reopens HistoryFile if it's removed or replaced by others,
+// like logrotate does, so the commands aren't written to the unlinked file.
+func (o *opHistory) reopenIfMissing() error {
+	fi, err := os.Stat(o.cfg.HistoryFile)
+	if err == nil {
+		if cur, err := o.fd.Stat(); err != nil || os.SameFile(fi, cur) {
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := o.openHistoryFile(o.cfg.HistoryFile)
+	if err != nil {
+		return err
+	}
+	o.fd.Close()
+	o.fd = f
+	o.readOffset = 0
+	if fi, err := f.Stat(); err == nil {
+		o.readOffset, o.ownWrites = fi.Size(), nil
+	}
+	return nil
+}
+
+// rotateCount is how many rotated files are kept, see HistoryRotateCount
+func (o *opHistory) rotateCount() int {
+	if o.cfg.HistoryRotateCount > 0 {
+		return o.cfg.HistoryRotateCount
+	}
+	return 1
+}
+
+// rotatedPath is the i-th file rotated by HistoryMaxBytes, the newest is the 1st
+func (o *opHistory) rotatedPath(i int) string {
+	return o.cfg.HistoryFile + "." + strconv.Itoa(i)
+}
+
+// rotateLocked renames HistoryFile with the ".1" suffix and starts a new one,
+// the rotated ones are shifted to make room for it
+func (o *opHistory) rotateLocked() error {
+	// the opened file can't be renamed on windows
+	o.fd.Close()
+	n := o.rotateCount()
+	os.Remove(o.rotatedPath(n))
+	if o.cfg.HistorySidecar {
+		os.Remove(o.rotatedPath(n) + ".meta")
+	}
+	for i := n - 1; i >= 1; i-- {
+		os.Rename(o.rotatedPath(i), o.rotatedPath(i+1))
+		if o.cfg.HistorySidecar {
+			os.Rename(o.rotatedPath(i)+".meta", o.rotatedPath(i+1)+".meta")
+		}
+	}
+	renameErr := os.Rename(o.cfg.HistoryFile, o.rotatedPath(1))
+	if o.cfg.HistorySidecar {
+		// the new HistoryFile starts with an empty sidecar
+		os.Rename(o.sidecarPath(), o.rotatedPath(1)+".meta")
+		o.sidecarPos = 0
+	}
+	f, err := o.openHistoryFile(o.cfg.HistoryFile)
+	if err != nil {
+		o.fd = nil
+		return err
+	}
+	o.fd = f
+	if fi, err := f.Stat(); err == nil {
+		o.readOffset, o.ownWrites = fi.Size(), nil
+	}
+	return renameErr
+}
+
+// renameFile is os.Rename, it's replaced in the tests
+var renameFile = os.Rename
+
+// Relocate moves HistoryFile to path and keeps saving to it there. The file is
+// copied if it can't be renamed across the devices.
+func (o *opHistory) Relocate(path string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	if o.cfg.HistoryReadOnly {
+		return ErrHistoryReadOnly
+	}
+	opened := o.fd != nil
+	if opened {
+		if o.dirty {
+			o.rewriteLocked()
+		}
+		if err := o.flushLocked(); err != nil {
+			return err
+		}
+		// the opened file can't be renamed on windows
+		o.fd.Close()
+		o.fd = nil
+	}
+	if o.cfg.HistoryFile != "" {
+		err := renameFile(o.cfg.HistoryFile, path)
+		if errors.Is(err, syscall.EXDEV) {
+			err = o.moveFile(o.cfg.HistoryFile, path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			// keep saving to where it was
+			if f, e := o.openHistoryFile(o.cfg.HistoryFile); e == nil {
+				o.fd = f
+			}
+			return &HistoryError{Op: "relocate", Path: path, Err: err}
+		}
+		if o.cfg.HistorySidecar {
+			// it's only the metadata, the commands are loaded without it if it's lost
+			meta := o.sidecarPath()
+			if err := renameFile(meta, path+".meta"); errors.Is(err, syscall.EXDEV) {
+				o.moveFile(meta, path+".meta")
+			}
+		}
+	}
+	o.cfg.HistoryFile = path
+	if !opened {
+		// it's opened by Init
+		return nil
+	}
+	f, err := o.openHistoryFile(path)
+	if err != nil {
+		return &HistoryError{Op: "relocate", Path: path, Err: err}
+	}
+	o.fd = f
+	if fi, err := f.Stat(); err == nil {
+		o.readOffset, o.ownWrites = fi.Size(), nil
+	}
+	return nil
+}
+
+// moveFile copies the file from src to dst and removes src
+func (o *opHistory) moveFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, o.fileMode())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+// writeFull retries the short write until all the data is written
+func writeFull(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Flush writes the commands not saved yet by HistoryFlushCount, HistoryFlushInterval
+// or HistoryCompress into HistoryFile, and commits it to the disk.
+func (o *opHistory) Flush() error {
+	// the entries are read by the rewriting
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	if o.dirty {
+		unlock := o.lockHistoryFile()
+		err := o.rewriteLocked()
+		unlock()
+		if err != nil {
+			return &HistoryError{Op: "append", Path: o.cfg.HistoryFile, Err: err}
+		}
+	}
+	if err := o.flushLocked(); err != nil {
+		return &HistoryError{Op: "append", Path: o.cfg.HistoryFile, Err: err}
+	}
+	if o.fd == nil || o.cfg.HistoryReadOnly {
+		return nil
+	}
+	if err := o.fd.Sync(); err != nil {
+		return &HistoryError{Op: "append", Path: o.cfg.HistoryFile, Err: err}
+	}
+	return nil
+}
+
+func (o *opHistory) Close() {
+	o.close(false)
+}
+
+// CloseSession is Close at the end of the session, HistoryFile is compacted
+// by HistoryCompactOnClose then. the other closings, e.g. by CloseHistory or
+// switching to the password mode, leave it as is.
+func (o *opHistory) CloseSession() {
+	o.close(true)
+}
+
+func (o *opHistory) close(compact bool) {
+	// the entries are read by the rewriting
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	if o.dirty {
+		unlock := o.lockHistoryFile()
+		o.rewriteLocked()
+		unlock()
+	}
+	o.flushLocked()
+	if compact && o.cfg.HistoryCompactOnClose {
+		o.compactFileLocked()
+	}
+	if o.fd != nil {
+		o.fd.Close()
+		o.fd = nil
+	}
+	o.closed = true
+}
+
+// compactFileLocked reloads HistoryFile with the commands appended by others,
+// and rewrites it deduplicated and trimmed, see HistoryCompactOnClose
+func (o *opHistory) compactFileLocked() {
+	if o.fd == nil || o.cfg.HistoryReadOnly || o.cfg.HistoryDryRun {
+		return
+	}
+	unlock := o.lockHistoryFile()
+	defer unlock()
+	f, err := os.Open(o.cfg.HistoryFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var src io.Reader = f
+	if o.compressed() {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return
+		}
+		defer gz.Close()
+		src = gz
+	}
+	file := newOpHistory(o.cfg)
+	file.silent = true
+	if o.cfg.HistorySidecar {
+		file.sidecar = file.readSidecar()
+	}
+	if _, _, err := file.loadFrom(src, loadFile, nil); err != nil {
+		// don't clobber the file we can't read
+		return
+	}
+	file.Compact()
+	file.rewriteLocked()
+	if file.fd != nil {
+		file.fd.Close()
+	}
+}
+
+// searchMatcher returns a function which reports the span of each occurrence
+// of rs in the item from left to right, as the start and end index of the runes.
+// the occurrences are found from the end to front if bck is set, which only
+// matters when they overlap. with HistorySearchFuzzy, each matched rune of the
+// best match is a span.
+func (o *opHistory) searchMatcher(rs []rune, bck, fold bool) func(item []rune) [][2]int {
+	if o.cfg.HistorySearchFuzzy {
+		return func(item []rune) [][2]int {
+			return fuzzySpans(item, rs, fold)
+		}
+	}
+	if o.cfg.HistorySearchRegex {
+		expr := string(rs)
+		if fold {
+			expr = "(?i)" + expr
+		}
+		if re, err := regexp.Compile(expr); err == nil {
+			return func(item []rune) [][2]int {
+				s := string(item)
+				var spans [][2]int
+				for _, loc := range re.FindAllStringIndex(s, -1) {
+					start := utf8.RuneCountInString(s[:loc[0]])
+					spans = append(spans, [2]int{start, start + utf8.RuneCountInString(s[loc[0]:loc[1]])})
+				}
+				return spans
+			}
+		}
+	}
+	isWord := func(r []rune, idx int) bool {
+		return !o.cfg.HistorySearchWholeWord ||
+			(idx == 0 || IsWordBreak(r[idx-1])) &&
+				(idx+len(rs) == len(r) || IsWordBreak(r[idx+len(rs)]))
+	}
+	spans := func(item, rs []rune) [][2]int {
+		if len(rs) == 0 {
+			return nil
+		}
+		var ret [][2]int
+		if bck {
+			for end := len(item); ; {
+				idx := runes.IndexAllBckEx(item[:end], rs, fold)
+				if idx < 0 {
+					break
+				}
+				if isWord(item, idx) {
+					ret = append(ret, [2]int{idx, idx + len(rs)})
+					end = idx
+				} else {
+					end = idx + len(rs) - 1
+				}
+			}
+			for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+				ret[i], ret[j] = ret[j], ret[i]
+			}
+			return ret
+		}
+		for from := 0; ; {
+			idx := runes.IndexAllFromEx(item, rs, from, fold)
+			if idx < 0 {
+				return ret
+			}
+			if isWord(item, idx) {
+				ret = append(ret, [2]int{idx, idx + len(rs)})
+				from = idx + len(rs)
+			} else {
+				from = idx + 1
+			}
+		}
+	}
+	if o.cfg.HistorySearchNormalize {
+		rs, _ = runes.Compose(rs)
+		return func(item []rune) [][2]int {
+			// map the spans back to the item
+			composed, pos := runes.Compose(item)
+			ret := spans(composed, rs)
+			for i, span := range ret {
+				end := len(item)
+				if span[1] < len(pos) {
+					end = pos[span[1]]
+				}
+				ret[i] = [2]int{pos[span[0]], end}
+			}
+			return ret
+		}
+	}
+	return func(item []rune) [][2]int {
+		return spans(item, rs)
 	}
 }
 
-func (o *opHistory) initHistory() {
-	if o.cfg.HistoryFile != "" {
-		o.historyUpdatePath(o.cfg.HistoryFile)
+// matchIndex returns the start of the first span, or the last one if bck is
+// set. it's -1 if there is none.
+func matchIndex(spans [][2]int, bck bool) int {
+	if len(spans) == 0 {
+		return -1
+	}
+	if bck {
+		return spans[len(spans)-1][0]
 	}
+	return spans[0][0]
 }
 
-// only called by newOpHistory
-func (o *opHistory) historyUpdatePath(path string) {
-	o.fdLock.Lock()
-	defer o.fdLock.Unlock()
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
+// fuzzyIndex matches the runes of sub in order, but not necessarily adjacent.
+// It returns the index of the first matched rune and the count of runes skipped between matches.
+func fuzzyIndex(r, sub []rune, fold bool) (idx, gaps int) {
+	idx = -1
+	if len(sub) == 0 {
 		return
 	}
-	o.fd = f
-	r := bufio.NewReader(o.fd)
-	total := 0
-	for ; ; total++ {
-		line, err := r.ReadString('\n')
-		if err != nil {
+	for i := range r {
+		if !runes.EqualRune(r[i], sub[0], fold) {
+			continue
+		}
+		g, j := 0, 1
+		for k := i + 1; k < len(r) && j < len(sub); k++ {
+			if runes.EqualRune(r[k], sub[j], fold) {
+				j++
+			} else {
+				g++
+			}
+		}
+		if j < len(sub) {
+			// the later start can't match either
 			break
 		}
-		// ignore the empty line
-		line = strings.TrimSpace(line)
-		if len(line) == 0 {
-			continue
+		if idx < 0 || g < gaps {
+			idx, gaps = i, g
 		}
-		o.Push([]rune(line))
-		o.Compact()
 	}
-	if total > o.cfg.HistoryLimit {
-		o.rewriteLocked()
-	}
-	o.historyVer++
-	o.Push(nil)
 	return
 }
 
-func (o *opHistory) Compact() {
-	for o.history.Len() > o.cfg.HistoryLimit && o.history.Len() > 0 {
-		o.history.Remove(o.history.Front())
+// fuzzySpans returns the span of each rune matched by fuzzyIndex
+func fuzzySpans(r, sub []rune, fold bool) [][2]int {
+	idx, _ := fuzzyIndex(r, sub, fold)
+	if idx < 0 {
+		return nil
+	}
+	ret := [][2]int{{idx, idx + 1}}
+	for k, j := idx+1, 1; k < len(r) && j < len(sub); k++ {
+		if runes.EqualRune(r[k], sub[j], fold) {
+			ret = append(ret, [2]int{k, k + 1})
+			j++
+		}
 	}
+	return ret
 }
 
-func (o *opHistory) Rewrite() {
-	o.fdLock.Lock()
-	defer o.fdLock.Unlock()
-	o.rewriteLocked()
+// searchable reports whether elem is taken into account by searching
+func (o *opHistory) searchable(elem *list.Element) bool {
+	if o.isSentinel(elem) {
+		return o.cfg.HistorySearchIncludeCurrent
+	}
+	return !o.cfg.HistorySearchSessionOnly || elem.Value.(*hisItem).Session
 }
 
-func (o *opHistory) rewriteLocked() {
-	if o.cfg.HistoryFile == "" {
-		return
-	}
+// SearchResult is a command found by Search
+type SearchResult struct {
+	Line []rune
+	// the index of the first matched rune in Line
+	MatchStart int
+	// the number of the command, as shown by DumpHistory
+	Seq int
+}
 
-	tmpFile := o.cfg.HistoryFile + ".tmp"
-	fd, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0666)
-	if err != nil {
-		return
+// Search returns up to limit commands matching query by the searching options,
+// without a limit if it's <= 0. They're the newest first, or the fewest gaps first
+// with HistorySearchFuzzy. The duplicated commands are returned once.
+// Unlike FindBck, it doesn't move the current item.
+func (o *opHistory) Search(query []rune, limit int) []SearchResult {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	type result struct {
+		item *hisItem
+		idx  int
+		gaps int
+	}
+	var results []result
+	seen := make(map[string]bool)
+	match := o.searchMatcher(query, true, o.cfg.HistorySearchFold)
+	o.walk(true, func(item *hisItem) bool {
+		if !o.cfg.HistorySearchSessionOnly || item.Session {
+			var idx, gaps int
+			if o.cfg.HistorySearchFuzzy {
+				idx, gaps = fuzzyIndex(item.Source, query, o.cfg.HistorySearchFold)
+			} else {
+				idx = matchIndex(match(item.Source), true)
+			}
+			if idx >= 0 && !seen[string(item.Source)] {
+				seen[string(item.Source)] = true
+				results = append(results, result{item, idx, gaps})
+			}
+		}
+		// the fuzzy results are ranked after all are found
+		return o.cfg.HistorySearchFuzzy || limit <= 0 || len(results) < limit
+	})
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].gaps < results[j].gaps
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
 	}
+	ret := make([]SearchResult, len(results))
+	for i, r := range results {
+		ret[i] = SearchResult{Line: runes.Copy(r.item.Source), MatchStart: r.idx, Seq: r.item.Seq}
+	}
+	return ret
+}
 
-	buf := bufio.NewWriter(fd)
-	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
-		buf.WriteString(string(elem.Value.(*hisItem).Source) + "\n")
+// findFuzzy walks all the items from current and returns the best matched one.
+// The current item is only considered on a new search, so that searching again moves on.
+func (o *opHistory) findFuzzy(isNewSearch bool, rs []rune, bck, fold bool) (int, *list.Element) {
+	bestIdx, bestGaps := -1, 0
+	var best *list.Element
+	for elem := o.current; elem != nil; {
+		if (elem != o.current || isNewSearch) && o.searchable(elem) {
+			idx, gaps := fuzzyIndex(o.showItem(elem.Value), rs, fold)
+			if idx >= 0 && (best == nil || gaps < bestGaps || gaps == bestGaps && idx < bestIdx) {
+				best, bestIdx, bestGaps = elem, idx, gaps
+			}
+		}
+		if bck {
+			elem = elem.Prev()
+		} else {
+			elem = elem.Next()
+		}
 	}
-	buf.Flush()
+	return bestIdx, best
+}
 
-	// replace history file
-	if err = os.Rename(tmpFile, o.cfg.HistoryFile); err != nil {
-		fd.Close()
-		return
+// foldFor returns HistorySearchFold as of the start of the search, it's only
+// read again on a new search. so toggling it midway doesn't shift the matches
+// which are found by the same search.
+func (o *opHistory) foldFor(isNewSearch bool) bool {
+	if isNewSearch || !o.searchFoldSet {
+		o.searchFold, o.searchFoldSet = o.cfg.HistorySearchFold, true
 	}
+	return o.searchFold
+}
 
-	if o.fd != nil {
-		o.fd.Close()
+// findAndMove finds rs like FindBck or FindFwd and moves current to the found
+// item, it returns the index of rs and a copy of the item as it's shown. It's
+// done at once so the item can't be evicted by others in between.
+func (o *opHistory) findAndMove(bck, isNewSearch bool, rs []rune, start int) (int, []rune, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	find := o.findFwd
+	if bck {
+		find = o.findBck
 	}
-	// fd is write only, just satisfy what we need.
-	o.fd = fd
+	idx, elem := find(isNewSearch, rs, start)
+	if elem == nil {
+		return idx, nil, false
+	}
+	o.current = elem
+	return idx, runes.Copy(o.showItem(elem.Value)), true
 }
 
-func (o *opHistory) Close() {
-	o.fdLock.Lock()
-	defer o.fdLock.Unlock()
-	if o.fd != nil {
-		o.fd.Close()
+// currentMatches returns the span of each match of rs in the item which
+// current is at, by the searching options and the fold of the last search
+func (o *opHistory) currentMatches(rs []rune) [][2]int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	if o.current == nil {
+		return nil
 	}
+	return o.searchMatcher(rs, false, o.searchFold)(o.showItem(o.current.Value))
 }
 
 func (o *opHistory) FindBck(isNewSearch bool, rs []rune, start int) (int, *list.Element) {
+	// foldFor may take a new snapshot
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.findBck(isNewSearch, rs, start)
+}
+
+func (o *opHistory) findBck(isNewSearch bool, rs []rune, start int) (int, *list.Element) {
+	fold := o.foldFor(isNewSearch)
+	if o.cfg.HistorySearchFuzzy {
+		return o.findFuzzy(isNewSearch, rs, true, fold)
+	}
+	match := o.searchMatcher(rs, true, fold)
 	for elem := o.current; elem != nil; elem = elem.Prev() {
+		if !o.searchable(elem) {
+			continue
+		}
 		item := o.showItem(elem.Value)
 		if isNewSearch {
 			start += len(rs)
@@ -155,7 +2749,7 @@ func (o *opHistory) FindBck(isNewSearch bool, rs []rune, start int) (int, *list.
 				item = item[:start]
 			}
 		}
-		idx := runes.IndexAllBckEx(item, rs, o.cfg.HistorySearchFold)
+		idx := matchIndex(match(item), true)
 		if idx < 0 {
 			continue
 		}
@@ -165,22 +2759,38 @@ func (o *opHistory) FindBck(isNewSearch bool, rs []rune, start int) (int, *list.
 }
 
 func (o *opHistory) FindFwd(isNewSearch bool, rs []rune, start int) (int, *list.Element) {
+	// foldFor may take a new snapshot
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.findFwd(isNewSearch, rs, start)
+}
+
+func (o *opHistory) findFwd(isNewSearch bool, rs []rune, start int) (int, *list.Element) {
+	fold := o.foldFor(isNewSearch)
+	if o.cfg.HistorySearchFuzzy {
+		return o.findFuzzy(isNewSearch, rs, false, fold)
+	}
+	match := o.searchMatcher(rs, false, fold)
+	if isNewSearch {
+		// the cursor is at the end of the last match which is one rune shorter,
+		// search from where it starts so the match extends in place.
+		start -= len(rs) - 1
+		if start < 0 {
+			start = 0
+		}
+	}
 	for elem := o.current; elem != nil; elem = elem.Next() {
-		item := o.showItem(elem.Value)
-		if isNewSearch {
-			start -= len(rs)
-			if start < 0 {
-				start = 0
-			}
+		if !o.searchable(elem) {
+			continue
 		}
+		item := o.showItem(elem.Value)
 		if elem == o.current {
-			if len(item)-1 >= start {
-				item = item[start:]
-			} else {
+			if start > len(item) {
 				continue
 			}
+			item = item[start:]
 		}
-		idx := runes.IndexAllEx(item, rs, o.cfg.HistorySearchFold)
+		idx := matchIndex(match(item), false)
 		if idx < 0 {
 			continue
 		}
@@ -201,38 +2811,241 @@ func (o *opHistory) showItem(obj interface{}) []rune {
 }
 
 func (o *opHistory) Prev() []rune {
-	if o.current == nil {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var prefix []rune
+	if o.cfg.HistorySearchPrefix {
+		prefix = o.editing()
+	}
+	return o.prevPrefix(prefix)
+}
+
+func (o *opHistory) Next() ([]rune, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var prefix []rune
+	if o.cfg.HistorySearchPrefix {
+		prefix = o.editing()
+	}
+	return o.nextPrefix(prefix)
+}
+
+// editing returns the line being edited for the next command
+func (o *opHistory) editing() []rune {
+	back := o.history.Back()
+	if back == nil {
 		return nil
 	}
-	current := o.current.Prev()
-	if current == nil {
+	return o.showItem(back.Value)
+}
+
+func (o *opHistory) hasPrefix(r, prefix []rune) bool {
+	return runes.HasPrefixEx(r, prefix, o.cfg.HistoryPrefixFold.fold(o.cfg.HistorySearchFold))
+}
+
+// navigable reports whether Prev/Next stop at elem, the blank entries are
+// skipped unless HistoryKeepBlank. the editing line is always reachable.
+func (o *opHistory) navigable(elem *list.Element) bool {
+	if o.cfg.HistoryKeepBlank || elem == o.history.Back() {
+		return true
+	}
+	return len(strings.TrimSpace(string(elem.Value.(*hisItem).Source))) > 0
+}
+
+// PrevPrefix moves to the previous item starting with prefix
+func (o *opHistory) PrevPrefix(prefix []rune) []rune {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.prevPrefix(prefix)
+}
+
+func (o *opHistory) prevPrefix(prefix []rune) []rune {
+	if o.current == nil {
 		return nil
 	}
-	o.current = current
-	return runes.Copy(o.showItem(current.Value))
+	for current := o.before(o.current); current != nil; current = o.before(current) {
+		if item := o.showItem(current.Value); o.navigable(current) && o.hasPrefix(item, prefix) {
+			o.current = current
+			return runes.Copy(item)
+		}
+	}
+	if o.cfg.HistoryWrap {
+		// wrap to the newest one, the editing line is reachable by Next
+		start := o.history.Back()
+		if o.isSentinel(start) {
+			start = o.before(start)
+		}
+		for current := start; current != nil && current != o.current; current = o.before(current) {
+			if item := o.showItem(current.Value); o.navigable(current) && o.hasPrefix(item, prefix) {
+				o.current = current
+				return runes.Copy(item)
+			}
+		}
+	}
+	return nil
 }
 
-func (o *opHistory) Next() ([]rune, bool) {
+// NextPrefix moves to the next item starting with prefix
+func (o *opHistory) NextPrefix(prefix []rune) ([]rune, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.nextPrefix(prefix)
+}
+
+func (o *opHistory) nextPrefix(prefix []rune) ([]rune, bool) {
 	if o.current == nil {
 		return nil, false
 	}
-	current := o.current.Next()
-	if current == nil {
-		return nil, false
+	for current := o.after(o.current); current != nil; current = o.after(current) {
+		if item := o.showItem(current.Value); o.navigable(current) && o.hasPrefix(item, prefix) {
+			o.current = current
+			return runes.Copy(item), true
+		}
+	}
+	if o.cfg.HistoryWrap {
+		for current := o.first(); current != nil && current != o.current; current = o.after(current) {
+			if item := o.showItem(current.Value); o.navigable(current) && o.hasPrefix(item, prefix) {
+				o.current = current
+				return runes.Copy(item), true
+			}
+		}
 	}
+	return nil, false
+}
 
-	o.current = current
-	return runes.Copy(o.showItem(current.Value)), true
+// navOrder returns the navigation order by HistoryOrderFunc, nil if it's not set
+func (o *opHistory) navOrder() []*list.Element {
+	if o.cfg.HistoryOrderFunc == nil {
+		return nil
+	}
+	if o.order != nil {
+		return o.order
+	}
+	var elems []*list.Element
+	var entries [][]rune
+	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+		if !o.isSentinel(elem) {
+			elems = append(elems, elem)
+			entries = append(entries, runes.Copy(elem.Value.(*hisItem).Source))
+		}
+	}
+	perm := o.cfg.HistoryOrderFunc(entries)
+	o.order = make([]*list.Element, 0, len(elems))
+	o.orderPos = make(map[*list.Element]int, len(elems))
+	for _, i := range perm {
+		if i < 0 || i >= len(elems) || o.orderPos[elems[i]] != 0 {
+			break
+		}
+		o.orderPos[elems[i]] = len(o.order) + 1
+		o.order = append(o.order, elems[i])
+	}
+	if len(o.order) != len(elems) {
+		// not a permutation, keep the chronological order
+		o.order = elems
+		for i, elem := range elems {
+			o.orderPos[elem] = i + 1
+		}
+	}
+	return o.order
+}
+
+// before returns the item before elem in the navigation order,
+// the last one is before the editing line
+func (o *opHistory) before(elem *list.Element) *list.Element {
+	order := o.navOrder()
+	if order == nil {
+		return elem.Prev()
+	}
+	i := o.orderPos[elem] - 1
+	if i < 0 {
+		// the editing line
+		i = len(order)
+	}
+	if i == 0 {
+		return nil
+	}
+	return order[i-1]
+}
+
+// after returns the item after elem in the navigation order
+func (o *opHistory) after(elem *list.Element) *list.Element {
+	order := o.navOrder()
+	if order == nil {
+		return elem.Next()
+	}
+	i := o.orderPos[elem] - 1
+	if i < 0 {
+		return nil
+	}
+	if i == len(order)-1 {
+		if back := o.history.Back(); o.isSentinel(back) {
+			return back
+		}
+		return nil
+	}
+	return order[i+1]
+}
+
+// first returns the first item in the navigation order
+func (o *opHistory) first() *list.Element {
+	if order := o.navOrder(); len(order) > 0 {
+		return order[0]
+	}
+	return o.history.Front()
+}
+
+// historyCursor is the item Prev/Next are at, see snapshotCursor
+type historyCursor struct {
+	elem *list.Element
+}
+
+// snapshotCursor saves the item Prev/Next are at, e.g. before searching
+func (o *opHistory) snapshotCursor() historyCursor {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return historyCursor{elem: o.current}
+}
+
+// restoreCursor moves back to the item saved by snapshotCursor, or the editing
+// line if it's gone from history since then
+func (o *opHistory) restoreCursor(c historyCursor) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for elem := o.history.Back(); elem != nil; elem = elem.Prev() {
+		if elem == c.elem {
+			o.current = elem
+			return
+		}
+	}
+	o.current = o.history.Back()
 }
 
 // Disable the current history
 func (o *opHistory) Disable() {
-	o.enable = false
+	o.SetEnabled(false)
 }
 
 // Enable the current history
 func (o *opHistory) Enable() {
-	o.enable = true
+	o.SetEnabled(true)
+}
+
+// SetEnabled enables or disables the current history, it returns the previous
+// state so it can be restored
+func (o *opHistory) SetEnabled(enable bool) (prev bool) {
+	o.lock.Lock()
+	prev, o.enable = o.enable, enable
+	o.lock.Unlock()
+	o.fdLock.Lock()
+	closed := o.closed
+	o.fdLock.Unlock()
+	if enable && !closed {
+		// HistoryFile isn't opened if it's disabled by DisableHistory,
+		// the error is reported by OpenHistory then. It's kept closed
+		// after CloseHistory until OpenHistory.
+		o.init()
+	}
+	return prev
 }
 
 func (o *opHistory) debug() {
@@ -240,10 +3053,31 @@ func (o *opHistory) debug() {
 	for item := o.history.Front(); item != nil; item = item.Next() {
 		Debug(fmt.Sprintf("%+v", item.Value))
 	}
+	Debug("live Tmp buffers:", o.liveTmp())
+}
+
+// liveTmp counts the items holding an edit in Tmp, they're all in o.edited
+// and released once the version moves on
+func (o *opHistory) liveTmp() (n int) {
+	for _, item := range o.edited {
+		if item.Tmp != nil {
+			n++
+		}
+	}
+	return
 }
 
 // save history
 func (o *opHistory) New(current []rune) (err error) {
+	var committed []rune
+	defer func() {
+		// called without the locks, so the callback is free to use history
+		if len(committed) > 0 && err == nil {
+			o.onCommit(committed)
+		}
+	}()
+	o.lock.Lock()
+	defer o.lock.Unlock()
 
 	// history deactivated
 	if !o.enable {
@@ -252,15 +3086,26 @@ func (o *opHistory) New(current []rune) (err error) {
 
 	current = runes.Copy(current)
 
+	current, keep := o.fitEntry(current)
+	if !keep || o.shouldIgnore(current) {
+		o.current = o.history.Back()
+		if o.current != nil {
+			o.current.Value.(*hisItem).Clean()
+		}
+		o.bumpVersion()
+		return nil
+	}
+
 	// if just use last command without modify
 	// just clean lastest history
 	if back := o.history.Back(); back != nil {
-		prev := back.Prev()
+		prev := o.kept(back.Prev())
 		if prev != nil {
-			if runes.Equal(current, prev.Value.(*hisItem).Source) {
+			if o.cfg.HistoryDedup != DedupNone &&
+				o.equalLine(current, prev.Value.(*hisItem).Source) {
 				o.current = o.history.Back()
 				o.current.Value.(*hisItem).Clean()
-				o.historyVer++
+				o.bumpVersion()
 				return nil
 			}
 		}
@@ -270,7 +3115,7 @@ func (o *opHistory) New(current []rune) (err error) {
 		o.current = o.history.Back()
 		if o.current != nil {
 			o.current.Value.(*hisItem).Clean()
-			o.historyVer++
+			o.bumpVersion()
 			return nil
 		}
 	}
@@ -284,47 +3129,267 @@ func (o *opHistory) New(current []rune) (err error) {
 		current = runes.Copy(currentItem.Tmp)
 	}
 
+	saved := current
+	if o.cfg.HistorySanitize != nil {
+		saved = o.cfg.HistorySanitize(runes.Copy(current))
+		if o.cfg.HistorySanitizeMemory {
+			current = saved
+		}
+	}
+	if isBlank(saved) {
+		// dropped like the ignored one, a blank line is never committed
+		o.current = o.history.Back()
+		if o.current != nil {
+			o.current.Value.(*hisItem).Clean()
+		}
+		o.bumpVersion()
+		return nil
+	}
+
 	// err only can be a IO error, just report
-	err = o.Update(current, true)
+	committed, err = o.update(current, saved, true)
 
 	// push a new one to commit current command
-	o.historyVer++
+	o.bumpVersion()
 	o.Push(nil)
 	return
 }
 
-func (o *opHistory) Revert() {
+// Add commits line as a command run before the editing one, which is left as is,
+// e.g. for replaying scripts. The rules of New are applied as well.
+func (o *opHistory) Add(line []rune) (err error) {
+	var committed []rune
+	defer func() {
+		// called without the locks, so the callback is free to use history
+		if len(committed) > 0 && err == nil {
+			o.onCommit(committed)
+		}
+	}()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.enable {
+		return nil
+	}
+
+	line, keep := o.fitEntry(runes.Copy(line))
+	if !keep || isBlank(line) || o.shouldIgnore(line) {
+		return nil
+	}
+	saved := line
+	if o.cfg.HistorySanitize != nil {
+		saved = o.cfg.HistorySanitize(runes.Copy(line))
+		if isBlank(saved) {
+			return nil
+		}
+		if o.cfg.HistorySanitizeMemory {
+			line = saved
+		}
+	}
+
+	back := o.history.Back()
+	if back == nil || !o.isSentinel(back) {
+		o.Push(nil)
+		back = o.history.Back()
+	}
+	if prev := o.kept(back.Prev()); prev != nil && o.cfg.HistoryDedup != DedupNone &&
+		o.equalLine(line, prev.Value.(*hisItem).Source) {
+		return nil
+	}
+	if o.cfg.HistoryDedup == DedupGlobal {
+		// keep the one being recalled
+		o.dedup(line, o.current)
+	}
+	item := &hisItem{Source: line, Time: time.Now(), Session: true}
+	if o.cfg.HistoryRecordDir {
+		item.Dir = o.workingDir()
+	}
+	o.number(item)
+	o.history.InsertBefore(item, back)
+	o.order = nil
+	o.emit(HistoryAdded, item.Source, item.Seq)
+
+	o.fdLock.Lock()
+	if o.fd != nil && !o.cfg.HistoryReadOnly {
+		if e := o.appendLocked(&hisItem{Source: saved, Time: item.Time, Dir: item.Dir}); e != nil {
+			err = &HistoryError{Op: "append", Path: o.cfg.HistoryFile, Err: e}
+		}
+	}
+	o.fdLock.Unlock()
+	committed = line
+	o.Compact()
+	return
+}
+
+// bumpVersion discards the edits of the items, releasing their Tmp
+func (o *opHistory) bumpVersion() {
+	for _, item := range o.edited {
+		item.Tmp = nil
+	}
+	o.edited = o.edited[:0]
 	o.historyVer++
+	o.order = nil
+}
+
+func (o *opHistory) Revert() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.bumpVersion()
 	o.current = o.history.Back()
 }
 
-func (o *opHistory) Update(s []rune, commit bool) (err error) {
+func (o *opHistory) Update(s []rune, commit bool) error {
+	o.lock.Lock()
+	committed, err := o.update(s, s, commit)
+	o.lock.Unlock()
+	// called without the locks, so the callback is free to use history
+	if len(committed) > 0 && err == nil {
+		o.onCommit(committed)
+	}
+	return err
+}
+
+// update sets the current item to s, saved is written to HistoryFile instead on commit
+func (o *opHistory) update(s, saved []rune, commit bool) (committed []rune, err error) {
 	o.fdLock.Lock()
 	defer o.fdLock.Unlock()
 	s = runes.Copy(s)
 	if o.current == nil {
-		o.Push(s)
-		o.Compact()
-		return
+		// there is no sentinel yet
+		o.Push(nil)
 	}
 	r := o.current.Value.(*hisItem)
-	r.Version = o.historyVer
+	if commit && isBlank(saved) {
+		// it'd be an empty line in HistoryFile, New and Add never get here
+		// with one, Update(s, true) is ignored then.
+		return nil, nil
+	}
 	if commit {
 		r.Source = s
-		if o.fd != nil {
+		r.Tmp = nil
+		r.Time = time.Now()
+		if o.cfg.HistoryRecordDir {
+			r.Dir = o.workingDir()
+		}
+		if o.cfg.HistoryDedup == DedupGlobal {
+			o.dedup(s, o.current)
+		}
+		if o.fd != nil && !o.cfg.HistoryReadOnly {
 			// just report the error
-			_, err = o.fd.Write([]byte(string(r.Source) + "\n"))
+			if e := o.appendLocked(&hisItem{Source: saved, Time: r.Time, Dir: r.Dir}); e != nil {
+				err = &HistoryError{Op: "append", Path: o.cfg.HistoryFile, Err: e}
+			}
 		}
+		committed = r.Source
+		o.number(r)
+		o.emit(HistoryAdded, r.Source, r.Seq)
 	} else {
+		if r.Version != o.historyVer {
+			o.edited = append(o.edited, r)
+		}
+		r.Version = o.historyVer
 		r.Tmp = append(r.Tmp[:0], s...)
+		o.emit(HistoryEdited, r.Tmp, r.Seq)
 	}
 	o.current.Value = r
 	o.Compact()
 	return
 }
 
+func (o *opHistory) onCommit(line []rune) {
+	if o.cfg.OnHistoryCommit == nil {
+		return
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			err := fmt.Errorf("history: OnHistoryCommit panic: %v", e)
+			o.send(HistoryEvent{Kind: HistoryWarning, Line: runes.Copy(line), Err: err})
+		}
+	}()
+	o.cfg.OnHistoryCommit(runes.Copy(line))
+}
+
+// AuditRecord is a committed command written by NewHistoryAuditor
+type AuditRecord struct {
+	Line []rune
+	Time time.Time
+	Pid  int
+	User string
+}
+
+// FormatAuditRecord formats the record like a syslog message, in one line:
+// `2006-01-02T15:04:05Z07:00 user[pid]: line`
+func FormatAuditRecord(r AuditRecord) string {
+	return fmt.Sprintf("%s %s[%d]: %s\n", r.Time.Format(time.RFC3339), r.User, r.Pid,
+		lineBreakReplacer.Replace(string(r.Line)))
+}
+
+// NewHistoryAuditor returns a function for OnHistoryCommit which writes each
+// committed command to w formatted by format, FormatAuditRecord if it's nil.
+// w is e.g. a syslog.Writer for the centralized auditing, it's write only and
+// history is still kept as usual. The errors of writing are ignored.
+func NewHistoryAuditor(w io.Writer, format func(AuditRecord) string) func(line []rune) {
+	if format == nil {
+		format = FormatAuditRecord
+	}
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	var mutex sync.Mutex
+	return func(line []rune) {
+		s := format(AuditRecord{Line: line, Time: time.Now(), Pid: os.Getpid(), User: name})
+		mutex.Lock()
+		io.WriteString(w, s)
+		mutex.Unlock()
+	}
+}
+
 func (o *opHistory) Push(s []rune) {
 	s = runes.Copy(s)
-	elem := o.history.PushBack(&hisItem{Source: s})
+	item := &hisItem{Source: s, Session: true}
+	if len(s) > 0 {
+		o.number(item)
+	}
+	elem := o.history.PushBack(item)
 	o.current = elem
+	o.order = nil
+}
+
+// emit sends the event to HistoryEvents, it's dropped if the channel is full
+func (o *opHistory) emit(kind HistoryEventKind, line []rune, seq int) {
+	if o.cfg.HistoryEvents == nil || o.silent {
+		return
+	}
+	e := HistoryEvent{Kind: kind, Seq: seq}
+	if line != nil {
+		e.Line = runes.Copy(line)
+	}
+	o.send(e)
+}
+
+// send sends the event to HistoryEvents without blocking
+func (o *opHistory) send(e HistoryEvent) {
+	if o.cfg.HistoryEvents == nil {
+		return
+	}
+	select {
+	case o.cfg.HistoryEvents <- e:
+	default:
+	}
+}
+
+// emitItem sends the event of the item, see emit
+func (o *opHistory) emitItem(kind HistoryEventKind, elem *list.Element) {
+	if o.cfg.HistoryEvents != nil {
+		item := elem.Value.(*hisItem)
+		o.emit(kind, item.Source, item.Seq)
+	}
+}
+
+// number gives the item the next sequence number if it hasn't got one
+func (o *opHistory) number(item *hisItem) {
+	if item.Seq == 0 {
+		o.seq++
+		item.Seq = o.seq
+	}
 }
@@ -0,0 +1,14 @@
+// +build aix os400 solaris linux,appengine
+
+package readline
+
+import "os"
+
+// advisory locking is not supported, HistoryFileLock is a no-op here.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+// +build windows
+
+package readline
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const _LOCKFILE_EXCLUSIVE_LOCK = 0x2
+
+func lockFile(f *os.File) error {
+	ol := new(syscall.Overlapped)
+	return kernel.LockFileEx(f.Fd(), _LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+}
+
+func unlockFile(f *os.File) error {
+	ol := new(syscall.Overlapped)
+	return kernel.UnlockFileEx(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+}
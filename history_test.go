@@ -0,0 +1,2341 @@
+package readline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chzyer/test"
+)
+
+func newTestHistory(cfg *Config) *opHistory {
+	if cfg.HistoryLimit == 0 {
+		cfg.HistoryLimit = 500
+	}
+	o := newOpHistory(cfg)
+	o.Push(nil)
+	return o
+}
+
+func newTestHistoryFile(t *testing.T, cfg *Config, content string) (*opHistory, string) {
+	fn := filepath.Join(t.TempDir(), "history")
+	test.Nil(ioutil.WriteFile(fn, []byte(content), 0666))
+	if cfg.HistoryLimit == 0 {
+		cfg.HistoryLimit = 500
+	}
+	cfg.HistoryFile = fn
+	o := newOpHistory(cfg)
+	o.Init()
+	return o, fn
+}
+
+func readTestFile(fn string) string {
+	data, err := ioutil.ReadFile(fn)
+	test.Nil(err)
+	return string(data)
+}
+
+// appendTestFile appends s to fn like another process does
+func appendTestFile(fn, s string) {
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0666)
+	test.Nil(err)
+	_, err = f.WriteString(s)
+	test.Nil(err)
+	test.Nil(f.Close())
+}
+
+func historyLines(o *opHistory) []string {
+	var ret []string
+	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+		if elem == o.history.Back() {
+			break
+		}
+		ret = append(ret, string(elem.Value.(*hisItem).Source))
+	}
+	return ret
+}
+
+func TestHistoryIgnore(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryIgnore: []string{"ls", "cd *", "*secret*"}})
+	ret := []struct {
+		Line   string
+		Ignore bool
+	}{
+		{"ls", true},
+		{"ls -l", false},
+		{"cd /tmp", true},
+		{"cd", false},
+		{"echo secret > a", true},
+		{"git status", false},
+	}
+	for _, r := range ret {
+		test.Equal(o.shouldIgnore([]rune(r.Line)), r.Ignore, fmt.Errorf("%v", r.Line))
+		test.Nil(o.New([]rune(r.Line)))
+	}
+	test.Equal(historyLines(o), []string{"ls -l", "cd", "git status"})
+}
+
+func TestHistoryIgnoreSpace(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryIgnoreSpace: true})
+	for _, line := range []string{" export TOKEN=1", "\texport TOKEN=2", "   ", "ls"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(historyLines(o), []string{"ls"})
+
+	// the recalled entry edited to begin with a space
+	test.Equal(string(o.Prev()), "ls")
+	test.Nil(o.Update([]rune(" ls -l"), false))
+	test.Nil(o.New([]rune(" ls -l")))
+	test.Equal(historyLines(o), []string{"ls"})
+
+	o = newTestHistory(&Config{})
+	test.Nil(o.New([]rune(" ls")))
+	test.Equal(historyLines(o), []string{" ls"})
+}
+
+func TestHistoryTimestamp(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{HistoryTimestamp: true}, "#1700000000\nls\npwd\n")
+	defer o.Close()
+	test.Equal(historyLines(o), []string{"ls", "pwd"})
+	test.Equal(o.history.Front().Value.(*hisItem).Time, time.Unix(1700000000, 0))
+	test.True(o.history.Front().Next().Value.(*hisItem).Time.IsZero())
+
+	test.Nil(o.New([]rune("whoami")))
+	item := o.history.Back().Prev().Value.(*hisItem)
+	test.Equal(readTestFile(fn), fmt.Sprintf("#1700000000\nls\npwd\n#%d\nwhoami\n", item.Time.Unix()))
+}
+
+func TestHistorySnapshot(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{})
+	test.Equal(len(o.History()), 0)
+	test.Nil(o.New([]rune("ls")))
+	test.Nil(o.New([]rune("pwd")))
+	ret := o.History()
+	test.Equal(rs(ret), []string{"ls", "pwd"})
+	ret[0][0] = 'x'
+	test.Equal(rs(o.History()), []string{"ls", "pwd"})
+}
+
+func TestHistoryClear(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{}, "ls\npwd\n")
+	defer o.Close()
+	test.Nil(o.Clear())
+	test.Equal(len(o.History()), 0)
+	test.Equal(readTestFile(fn), "")
+
+	test.Nil(o.New([]rune("whoami")))
+	test.Equal(rs(o.History()), []string{"whoami"})
+	test.Equal(readTestFile(fn), "whoami\n")
+
+	// appended by others after clearing
+	test.Nil(o.Clear())
+	appendTestFile(fn, "other-three\n")
+	test.Nil(o.Reload())
+	test.Equal(rs(o.History()), []string{"other-three"})
+}
+
+func TestHistoryReset(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{}, "ls\n")
+	defer o.Close()
+	o.Reset()
+	test.Nil(o.New(nil))
+	test.Nil(o.Update([]rune("pw"), false))
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(rs(o.History()), []string{"pwd"})
+	test.Equal(readTestFile(fn), "ls\npwd\n")
+
+	// without the sentinel
+	o = newOpHistory(&Config{HistoryLimit: 500})
+	test.Nil(o.New([]rune("x")))
+	test.Nil(o.Update([]rune("y"), false))
+	test.Equal(rs(o.History()), []string{"x"})
+}
+
+func TestHistoryDisable(t *testing.T) {
+	defer test.New(t)
+	fn := filepath.Join(t.TempDir(), "history")
+	o := newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 500, DisableHistory: true})
+	test.Nil(o.Init())
+	test.Nil(o.New([]rune("ls")))
+	_, err := os.Stat(fn)
+	test.True(os.IsNotExist(err))
+	test.Equal(len(o.History()), 0)
+
+	o.Enable()
+	defer o.Close()
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(readTestFile(fn), "pwd\n")
+
+	// in memory only, it's still navigated
+	o = newTestHistory(&Config{})
+	test.Nil(o.Init())
+	test.Nil(o.New([]rune("ls")))
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(string(o.Prev()), "pwd")
+	test.Equal(string(o.Prev()), "ls")
+	next, ok := o.Next()
+	test.True(ok)
+	test.Equal(string(next), "pwd")
+	o = newTestHistory(&Config{DisableHistory: true})
+	test.Nil(o.New([]rune("ls")))
+	test.Equal(len(o.History()), 0)
+}
+
+func TestHistoryDedupGlobal(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistoryDedup: DedupGlobal}
+	o, fn := newTestHistoryFile(t, cfg, "")
+	for _, line := range []string{"ls", "pwd", "ls", "make"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(rs(o.History()), []string{"pwd", "ls", "make"})
+	test.Equal(string(o.Prev()), "make")
+	test.Equal(string(o.Prev()), "ls")
+	o.Close()
+	test.Equal(readTestFile(fn), "ls\npwd\nls\nmake\n")
+
+	o = newOpHistory(cfg)
+	o.Init()
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"pwd", "ls", "make"})
+	test.Equal(readTestFile(fn), "pwd\nls\nmake\n")
+}
+
+func TestHistoryCaseFold(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistorySearchFold: true, HistoryDedupFold: CaseSensitive}
+	o := newTestHistory(cfg)
+	for _, line := range []string{"make", "MAKE", "ls"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(rs(o.History()), []string{"make", "MAKE", "ls"})
+	idx, elem := o.FindBck(true, []rune("Make"), 0)
+	test.Equal(idx, 0)
+	test.Equal(string(elem.Value.(*hisItem).Source), "MAKE")
+
+	// the others follow HistorySearchFold by default
+	cfg = &Config{HistorySearchFold: true, HistoryIgnore: []string{"SECRET*"}}
+	o = newTestHistory(cfg)
+	for _, line := range []string{"make", "MAKE", "secret key"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(rs(o.History()), []string{"make"})
+
+	// the same folding beyond ASCII for all of them
+	cfg = &Config{HistorySearchFold: true, HistoryIgnore: []string{"ÉCHO *"}}
+	o = newTestHistory(cfg)
+	for _, line := range []string{"café", "CAFÉ", "écho secret", "ls"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(rs(o.History()), []string{"café", "ls"})
+	idx, elem = o.FindBck(true, []rune("Afé"), 0)
+	test.Equal(idx, 1)
+	test.Equal(string(elem.Value.(*hisItem).Source), "café")
+}
+
+func TestHistorySameLineFunc(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistorySameLineFunc: func(a, b []rune) bool {
+		return strings.TrimSpace(string(a)) == strings.TrimSpace(string(b))
+	}})
+	for _, line := range []string{"ls ", "ls", "pwd"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(len(o.History()), 2)
+	test.Equal(strings.TrimSpace(rs(o.History())[0]), "ls")
+
+	// exact equality by default
+	o = newTestHistory(&Config{})
+	for _, line := range []string{"ls ", "ls"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(len(o.History()), 2)
+}
+
+func TestHistoryAdd(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{HistoryIgnore: []string{"secret*"}}, "ls\n")
+	defer o.Close()
+	test.Nil(o.Update([]rune("git st"), false))
+	test.Nil(o.Add([]rune("make")))
+	test.Nil(o.Add([]rune("make")))
+	test.Nil(o.Add([]rune("secret")))
+	test.Equal(rs(o.History()), []string{"ls", "make"})
+	test.Equal(string(o.editing()), "git st")
+	test.Equal(readTestFile(fn), "ls\nmake\n")
+
+	// the recalled command is kept
+	test.Equal(string(o.Prev()), "make")
+	test.Equal(string(o.Prev()), "ls")
+	test.Nil(o.Add([]rune("pwd")))
+	test.Equal(string(o.showItem(o.current.Value)), "ls")
+	line, _ := o.Next()
+	test.Equal(string(line), "make")
+	line, _ = o.Next()
+	test.Equal(string(line), "pwd")
+
+	// before any command is run
+	o = newTestHistory(&Config{})
+	test.Nil(o.Add([]rune("ls")))
+	test.Equal(string(o.Prev()), "ls")
+}
+
+func TestHistoryStats(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryDedup: DedupNone})
+	for _, line := range []string{"ls", "make", "ls", "pwd", "make", "ls"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	stats := o.Stats(2)
+	test.Equal(stats.Total, 6)
+	test.Equal(stats.Unique, 3)
+	test.Equal(len(stats.Top), 2)
+	test.Equal(string(stats.Top[0].Line), "ls")
+	test.Equal(stats.Top[0].Count, 3)
+	test.Equal(string(stats.Top[1].Line), "make")
+	test.Equal(stats.Top[1].Count, 2)
+	test.Equal(len(o.Stats(10).Top), 3)
+}
+
+func TestHistoryFileLimit(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{HistoryLimit: 2, HistoryFileLimit: 4}, "a\nb\nc\nd\ne\n")
+	test.Equal(rs(o.History()), []string{"d", "e"})
+	test.Equal(readTestFile(fn), "b\nc\nd\ne\n")
+	test.Nil(o.New([]rune("f")))
+	o.Rewrite()
+	test.Equal(rs(o.History()), []string{"e", "f"})
+	test.Equal(readTestFile(fn), "c\nd\ne\nf\n")
+	o.Close()
+
+	o, fn = newTestHistoryFile(t, &Config{HistoryLimit: 4, HistoryFileLimit: 2}, "a\nb\nc\nd\ne\n")
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"b", "c", "d", "e"})
+	test.Equal(readTestFile(fn), "d\ne\n")
+}
+
+func TestHistoryRewriteConcurrently(t *testing.T) {
+	defer test.New(t)
+	a, fn := newTestHistoryFile(t, &Config{}, "")
+	defer a.Close()
+	b := newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 500})
+	test.Nil(b.Init())
+	defer b.Close()
+	for i := 0; i < 100; i++ {
+		test.Nil(a.New([]rune(fmt.Sprintf("a%d", i))))
+		test.Nil(b.New([]rune(fmt.Sprintf("b%d", i))))
+	}
+	wantA := strings.Join(historyLines(a), "\n") + "\n"
+	wantB := strings.Join(historyLines(b), "\n") + "\n"
+
+	var wg sync.WaitGroup
+	for _, o := range []*opHistory{a, b} {
+		wg.Add(1)
+		go func(o *opHistory) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				o.Rewrite()
+			}
+		}(o)
+	}
+	wg.Wait()
+	got := readTestFile(fn)
+	test.True(got == wantA || got == wantB)
+	files, err := filepath.Glob(fn + ".*")
+	test.Nil(err)
+	test.Equal(len(files), 0)
+}
+
+func TestHistoryRecordDir(t *testing.T) {
+	defer test.New(t)
+	dir := "/home/a"
+	cfg := &Config{HistoryRecordDir: true, FuncGetDir: func() string { return dir }}
+	o, fn := newTestHistoryFile(t, cfg, "ls\n")
+	test.Nil(o.New([]rune("make")))
+	dir = "/tmp"
+	test.Nil(o.New([]rune("pwd")))
+	o.Close()
+	test.Equal(readTestFile(fn), "ls\n#dir /home/a\nmake\n#dir /tmp\npwd\n")
+
+	o = newOpHistory(cfg)
+	o.Init()
+	defer o.Close()
+	entries := o.Entries()
+	test.Equal(len(entries), 3)
+	test.Equal(entries[0].Dir, "")
+	test.Equal(string(entries[1].Line), "make")
+	test.Equal(entries[1].Dir, "/home/a")
+	test.Equal(entries[2].Dir, "/tmp")
+}
+
+func TestHistoryReleaseTmp(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryLimit: 10})
+	for i := 0; i < 1000; i++ {
+		test.Nil(o.New([]rune(fmt.Sprintf("echo %d", i))))
+		o.Prev()
+		test.Nil(o.Update([]rune("edited"), false))
+		if i%2 == 0 {
+			o.Revert()
+		} else {
+			test.Nil(o.New([]rune("edited")))
+		}
+	}
+	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+		test.Nil(elem.Value.(*hisItem).Tmp)
+	}
+	test.Equal(len(o.edited), 0)
+	test.True(cap(o.edited) <= 2)
+}
+
+func TestHistoryMaxEntry(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryMaxEntryBytes: 4})
+	for _, line := range []string{"ls", "你好你好", "你好你好你", "pwd -P"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(rs(o.History()), []string{"ls", "你好你好"})
+
+	o, fn := newTestHistoryFile(t, &Config{
+		HistoryMaxEntryBytes:    4,
+		HistoryTruncateOversize: true,
+	}, "ls\npwd -P\n")
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"ls", "pwd…"})
+	test.Equal(readTestFile(fn), "ls\npwd…\n")
+}
+
+type shortWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if len(b) > w.max {
+		b = b[:w.max]
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestHistoryWriteFull(t *testing.T) {
+	defer test.New(t)
+	w := &shortWriter{max: 3}
+	test.Nil(writeFull(w, []byte("git status\n")))
+	test.Equal(w.String(), "git status\n")
+
+	w = &shortWriter{max: 0}
+	test.Equal(writeFull(w, []byte("ls\n")), io.ErrShortWrite)
+}
+
+// failingReader returns err after reading the data
+type failingReader struct {
+	data *strings.Reader
+	err  error
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if r.data.Len() == 0 {
+		return 0, r.err
+	}
+	return r.data.Read(b)
+}
+
+func TestHistoryLoadReadError(t *testing.T) {
+	defer test.New(t)
+	errIO := errors.New("input/output error")
+	o := newOpHistory(&Config{HistoryLimit: 500})
+	total, _, err := o.loadFrom(&failingReader{data: strings.NewReader("ls\npwd\nma"), err: errIO}, loadFile, nil)
+	test.Equal(err, errIO)
+	test.Equal(total, 2)
+
+	total, _, err = o.loadFrom(strings.NewReader("ls\npwd\n"), loadFile, nil)
+	test.Nil(err)
+	test.Equal(total, 2)
+}
+
+func TestHistoryExpandPath(t *testing.T) {
+	defer test.New(t)
+	home, err := os.UserHomeDir()
+	test.Nil(err)
+	test.Equal(expandHistoryPath("~/.history"), home+"/.history")
+	test.Equal(expandHistoryPath("~"), home)
+	test.Equal(expandHistoryPath("$HOME/sub/file"), os.Getenv("HOME")+"/sub/file")
+	test.Equal(expandHistoryPath("/tmp/~/history"), "/tmp/~/history")
+	if u, err := user.Current(); err == nil {
+		test.Equal(expandHistoryPath("~"+u.Username+"/history"), u.HomeDir+"/history")
+	}
+	test.Equal(expandHistoryPath("~no-such-user/history"), "~no-such-user/history")
+
+	// the path is used as is
+	fn := filepath.Join(t.TempDir(), "$HOME")
+	op := &Operation{cfg: &Config{HistoryLimit: 500, HistoryNoExpand: true}}
+	op.SetHistoryPath(fn)
+	test.Nil(op.history.Init())
+	op.history.Close()
+	test.Equal(op.cfg.HistoryFile, fn)
+	_, err = os.Stat(fn)
+	test.Nil(err)
+}
+
+func TestHistorySkipGarbage(t *testing.T) {
+	defer test.New(t)
+	content := "ls\n\x00\x00\x00\nmake\x01\n\x01\x02\x03x\ngit\tst\n"
+	events := make(chan HistoryEvent, 8)
+	o, fn := newTestHistoryFile(t, &Config{HistorySkipGarbage: true, HistoryEvents: events}, content)
+	test.Equal(rs(o.History()), []string{"ls", "make\x01", "git\tst"})
+	test.Equal(len(events), 2)
+	for _, line := range []string{"\x00\x00\x00", "\x01\x02\x03x"} {
+		e := <-events
+		test.Equal(e.Kind, HistoryWarning)
+		test.Equal(e.Err, ErrHistoryGarbage)
+		test.Equal(string(e.Line), line)
+	}
+	o.Close()
+	test.Equal(readTestFile(fn), "ls\nmake\x01\ngit\tst\n")
+
+	o, _ = newTestHistoryFile(t, &Config{}, content)
+	defer o.Close()
+	test.Equal(len(o.History()), 5)
+}
+
+func TestHistorySetEnabled(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{})
+	test.True(o.SetEnabled(false))
+	test.False(o.SetEnabled(false))
+	test.Nil(o.New([]rune("secret")))
+	test.False(o.SetEnabled(true))
+	test.True(o.SetEnabled(true))
+	test.Nil(o.New([]rune("ls")))
+	test.Equal(rs(o.History()), []string{"ls"})
+
+	// still closed after toggling
+	o, fn := newTestHistoryFile(t, &Config{}, "")
+	defer o.Close()
+	test.Nil(o.New([]rune("ls")))
+	o.Close()
+	o.SetEnabled(false)
+	o.SetEnabled(true)
+	test.Nil(o.New([]rune("secret")))
+	test.Equal(readTestFile(fn), "ls\n")
+	test.Nil(o.Init())
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(readTestFile(fn), "ls\npwd\n")
+}
+
+func TestHistorySearchCancel(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{FuncIsTerminal: func() bool { return false }}
+	o := newTestHistory(cfg)
+	for _, line := range []string{"git push", "ls"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	buf := NewRuneBuffer(ioutil.Discard, "> ", cfg, 80)
+	buf.SetWithIdx(3, []rune("make te"))
+	test.Nil(o.Update(buf.Runes(), false))
+	s := newOpSearch(ioutil.Discard, buf, o, cfg, 80)
+
+	test.True(s.SearchMode(S_DIR_BCK))
+	s.SearchChar('g')
+	test.True(s.SearchMode(S_DIR_BCK))
+	test.Equal(string(buf.Runes()), "git push")
+	test.True(o.current != o.history.Back())
+
+	s.ExitSearchMode(true)
+	test.Equal(string(buf.Runes()), "make te")
+	test.Equal(buf.idx, 3)
+	test.True(o.current == o.history.Back())
+	test.Equal(string(o.showItem(o.current.Value)), "make te")
+}
+
+func TestHistoryCurrentMatches(t *testing.T) {
+	defer test.New(t)
+	ret := []struct {
+		Cfg   Config
+		Line  string
+		Query string
+		Spans [][2]int
+	}{
+		{Config{}, "git log; git push", "git", [][2]int{{0, 3}, {9, 12}}},
+		{Config{HistorySearchRegex: true}, "get a got", "g.t", [][2]int{{0, 3}, {6, 9}}},
+		{Config{HistorySearchWholeWord: true}, "port transport port", "port", [][2]int{{0, 4}, {15, 19}}},
+		{Config{HistorySearchFuzzy: true}, "git push", "gp", [][2]int{{0, 1}, {4, 5}}},
+		{Config{HistorySearchNormalize: true}, "cafe\u0301 caf\u00e9", "caf\u00e9", [][2]int{{0, 5}, {6, 10}}},
+	}
+	for idx, r := range ret {
+		cfg := r.Cfg
+		o := newTestHistory(&cfg)
+		test.Nil(o.New([]rune(r.Line)))
+		o.current = o.history.Front()
+		test.Equal(o.currentMatches([]rune(r.Query)), r.Spans, fmt.Errorf("%v", idx))
+	}
+}
+
+func TestHistorySearchUnderline(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{FuncIsTerminal: func() bool { return false }}
+	o := newTestHistory(cfg)
+	test.Nil(o.New([]rune("git log; git push")))
+	var out bytes.Buffer
+	buf := NewRuneBuffer(&out, "> ", cfg, 80)
+	s := newOpSearch(&out, buf, o, cfg, 80)
+	test.True(s.SearchMode(S_DIR_BCK))
+	for _, r := range "git" {
+		s.SearchChar(r)
+	}
+	test.Equal(s.Matches(), [][2]int{{0, 3}, {9, 12}})
+	out.Reset()
+	s.SearchRefresh(-1)
+	test.True(strings.HasSuffix(strings.SplitN(out.String(), "\n", 2)[0],
+		"\033[4mgit\033[0m log; \033[4mgit\033[0m"))
+}
+
+func TestHistorySearchRace(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{FuncIsTerminal: func() bool { return false }, HistoryLimit: 5}
+	o := newTestHistory(cfg)
+	buf := NewRuneBuffer(ioutil.Discard, "> ", cfg, 80)
+	s := newOpSearch(ioutil.Discard, buf, o, cfg, 80)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5000; i++ {
+			test.Nil(o.Add([]rune(fmt.Sprintf("git %d", i))))
+		}
+	}()
+	test.True(s.SearchMode(S_DIR_BCK))
+	for {
+		select {
+		case <-done:
+			s.ExitSearchMode(false)
+			return
+		default:
+		}
+		s.SearchChar('g')
+		s.Matches()
+		s.SearchMode(S_DIR_BCK)
+		s.SearchBackspace()
+	}
+}
+
+func TestHistoryNulDelimited(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistoryLineEnding: "\x00", HistoryTimestamp: true}
+	o, fn := newTestHistoryFile(t, cfg, "")
+	test.Nil(o.New([]rune("for i in 1 2\ndo echo $i\ndone")))
+	test.Nil(o.New([]rune("ls")))
+	o.Close()
+	test.True(strings.Contains(readTestFile(fn), "\x00for i in 1 2\ndo echo $i\ndone\x00"))
+
+	o = newOpHistory(cfg)
+	test.Nil(o.Init())
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"for i in 1 2\ndo echo $i\ndone", "ls"})
+}
+
+func TestHistoryCompress(t *testing.T) {
+	defer test.New(t)
+	fn := filepath.Join(t.TempDir(), "history.gz")
+	cfg := &Config{HistoryFile: fn, HistoryLimit: 500, HistoryCompressInterval: time.Hour}
+	o := newOpHistory(cfg)
+	o.Init()
+	test.Nil(o.New([]rune("ls")))
+	test.Nil(o.New([]rune("pwd")))
+	o.Close()
+
+	f, err := os.Open(fn)
+	test.Nil(err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	test.Nil(err)
+	data, err := ioutil.ReadAll(gz)
+	test.Nil(err)
+	test.Equal(string(data), "ls\npwd\n")
+
+	o = newOpHistory(cfg)
+	o.Init()
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"ls", "pwd"})
+}
+
+func TestHistorySearchRegex(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistorySearchRegex: true, HistorySearchFold: true})
+	for _, line := range []string{"git push", "ls -l", "GIT PULL origin"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	idx, elem := o.FindBck(true, []rune("git pu(ll|sh)"), 0)
+	test.Equal(idx, 0)
+	test.Equal(string(elem.Value.(*hisItem).Source), "GIT PULL origin")
+
+	idx, elem = o.FindBck(true, []rune("-l$"), 0)
+	test.Equal(idx, 3)
+	test.Equal(string(elem.Value.(*hisItem).Source), "ls -l")
+
+	// invalid expression is searched literally
+	idx, elem = o.FindBck(true, []rune("pu("), 0)
+	test.Equal(idx, -1)
+	test.Nil(elem)
+}
+
+func TestHistorySearchNormalize(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistorySearchNormalize: true})
+	test.Nil(o.New([]rune("e\u0301 cafe\u0301")))
+	// the index is in the original item
+	idx, elem := o.FindBck(true, []rune("caf\u00e9"), 0)
+	test.Equal(idx, 3)
+	test.Equal(string(elem.Value.(*hisItem).Source), "e\u0301 cafe\u0301")
+
+	o = newTestHistory(&Config{HistorySearchNormalize: true})
+	test.Nil(o.New([]rune("caf\u00e9")))
+	idx, _ = o.FindBck(true, []rune("cafe\u0301"), 0)
+	test.Equal(idx, 0)
+
+	// the combining marks in any order are the same, the span covers them all
+	o = newTestHistory(&Config{HistorySearchNormalize: true})
+	test.Nil(o.New([]rune("ls \u1ec7t")))
+	test.Nil(o.New([]rune("ls e\u0323\u0302t")))
+	o.current = o.history.Front()
+	test.Equal(o.currentMatches([]rune("e\u0302\u0323")), [][2]int{{3, 4}})
+	o.current = o.current.Next()
+	test.Equal(o.currentMatches([]rune("\u1ec7")), [][2]int{{3, 6}})
+	test.Equal(o.currentMatches([]rune("e\u0302\u0323t")), [][2]int{{3, 7}})
+}
+
+func TestHistorySearchWholeWord(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistorySearchWholeWord: true})
+	for _, line := range []string{"port 80", "transport port", "transport"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	idx, elem := o.FindBck(true, []rune("port"), 0)
+	test.Equal(idx, 10)
+	test.Equal(string(elem.Value.(*hisItem).Source), "transport port")
+
+	o.current = o.history.Front()
+	idx, elem = o.FindFwd(true, []rune("port"), 0)
+	test.Equal(idx, 0)
+	test.Equal(string(elem.Value.(*hisItem).Source), "port 80")
+	// the cursor is at the end of the match
+	idx, elem = o.FindFwd(false, []rune("port"), 4)
+	test.Equal(idx, 10)
+	test.Equal(string(elem.Value.(*hisItem).Source), "transport port")
+}
+
+func TestHistorySearch(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryDedup: DedupNone, HistorySearchFold: true})
+	for _, line := range []string{"git push", "ls", "GIT pull", "git push"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	current := o.current
+	ret := o.Search([]rune("git"), 0)
+	test.Equal(searchLines(ret), []string{"git push", "GIT pull"})
+	test.Equal(ret[0].Seq, 4)
+	test.Equal(ret[1].Seq, 3)
+	test.Equal(searchLines(o.Search([]rune("git"), 1)), []string{"git push"})
+	test.Equal(len(o.Search([]rune("xyz"), 0)), 0)
+	test.True(o.current == current)
+	ret = o.Search([]rune("pu"), 1)
+	test.Equal(ret[0].MatchStart, 4)
+
+	o = newTestHistory(&Config{HistorySearchFuzzy: true})
+	for _, line := range []string{"git checkout origin", "gco", "git commit"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(searchLines(o.Search([]rune("gco"), 2)), []string{"gco", "git commit"})
+}
+
+func searchLines(results []SearchResult) []string {
+	ret := make([]string, len(results))
+	for i, r := range results {
+		ret[i] = string(r.Line)
+	}
+	return ret
+}
+
+func TestHistorySearchFuzzy(t *testing.T) {
+	defer test.New(t)
+	ret := []struct {
+		Line  string
+		Query string
+		Idx   int
+		Gaps  int
+	}{
+		{"git checkout origin", "gco", 0, 7},
+		{"git commit", "gco", 0, 3},
+		{"log; git co", "gco", 5, 3},
+		{"go", "gco", -1, 0},
+	}
+	for _, r := range ret {
+		idx, gaps := fuzzyIndex([]rune(r.Line), []rune(r.Query), false)
+		test.Equal(idx, r.Idx, fmt.Errorf("%v", r.Line))
+		test.Equal(gaps, r.Gaps, fmt.Errorf("%v", r.Line))
+	}
+
+	o := newTestHistory(&Config{HistorySearchFuzzy: true})
+	for _, line := range []string{"git commit", "git checkout origin", "ls"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	idx, elem := o.FindBck(true, []rune("gco"), 0)
+	test.Equal(idx, 0)
+	test.Equal(string(elem.Value.(*hisItem).Source), "git commit")
+}
+
+func TestHistoryExportImport(t *testing.T) {
+	defer test.New(t)
+	for _, format := range []HistoryFormat{HistoryFormatText, HistoryFormatJSON} {
+		o := newTestHistory(&Config{HistoryTimestamp: true})
+		test.Nil(o.New([]rune("ls")))
+		test.Nil(o.New([]rune("pwd")))
+		buf := bytes.NewBuffer(nil)
+		test.Nil(o.Export(buf, format))
+
+		o2 := newTestHistory(&Config{HistoryTimestamp: true})
+		test.Nil(o2.New([]rune("whoami")))
+		test.Nil(o2.Update([]rune("ec"), false))
+		test.Nil(o2.Import(buf, format))
+		test.Equal(rs(o2.History()), []string{"whoami", "ls", "pwd"})
+		test.Equal(o2.history.Back().Prev().Value.(*hisItem).Time.Unix(),
+			o.history.Back().Prev().Value.(*hisItem).Time.Unix())
+		// the editing command is kept
+		test.Equal(string(o2.showItem(o2.current.Value)), "ec")
+	}
+
+	// seeded by the rows of another store
+	o := newTestHistory(&Config{})
+	test.Nil(o.Import(strings.NewReader(`{"line":"make","time":1700000000,"dir":"/src"}`), HistoryFormatJSON))
+	entries := o.Entries()
+	test.Equal(len(entries), 1)
+	test.Equal(entries[0].Time.Unix(), int64(1700000000))
+	test.Equal(entries[0].Dir, "/src")
+}
+
+func TestHistoryDump(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryLimit: 2})
+	test.Nil(o.New([]rune("ls")))
+	test.Nil(o.New([]rune("pwd")))
+	test.Nil(o.New([]rune("whoami")))
+	test.Nil(o.Update([]rune("ec"), false))
+
+	buf := bytes.NewBuffer(nil)
+	test.Nil(o.Dump(buf, true))
+	// the numbers are kept after "ls" is evicted
+	test.Equal(buf.String(), "    2  pwd\n    3  whoami\n")
+
+	buf.Reset()
+	test.Nil(o.Dump(buf, false))
+	test.Equal(buf.String(), "pwd\nwhoami\n")
+}
+
+func TestHistoryConcurrent(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryLimit: 10})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			o.New([]rune(fmt.Sprintf("echo %d", i)))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			test.Equal(len(o.History()), 10)
+			return
+		default:
+			o.History()
+		}
+	}
+}
+
+func TestHistorySuggest(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryDedup: DedupNone, HistorySearchFold: true})
+	for _, line := range []string{"git status", "git push", "git status", "git pull"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	// the recent one wins a tie
+	test.Equal(string(o.Suggest([]rune("git"))), "git pull")
+	test.Nil(o.New([]rune("git status")))
+	test.Equal(string(o.Suggest([]rune("GIT"))), "git status")
+	test.Equal(string(o.Suggest([]rune("git pu"))), "git pull")
+	test.Nil(o.Suggest([]rune("git status")))
+	test.Nil(o.Suggest([]rune("ls")))
+	test.Nil(o.Suggest(nil))
+
+	// the old frequent one outscores the newer ones, which can't stop the scan
+	o = newTestHistory(&Config{HistoryDedup: DedupNone})
+	for _, line := range []string{"make", "make", "make", "make", "make test", "make"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(string(o.Suggest([]rune("ma"))), "make")
+	test.Equal(string(o.Suggest([]rune("make"))), "make test")
+
+	// the tie is broken by the newest occurrence, not by which one reaches
+	// the score first
+	o = newTestHistory(&Config{HistoryDedup: DedupNone})
+	for _, line := range []string{"git a", "git b", "ls", "pwd", "git b", "git a"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(string(o.Suggest([]rune("git"))), "git a")
+}
+
+func TestHistoryWalk(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{})
+	for _, line := range []string{"ls", "pwd", "make"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	var lines []string
+	o.Walk(true, func(line []rune) bool {
+		lines = append(lines, string(line))
+		line[0] = 'x'
+		return len(lines) < 2
+	})
+	test.Equal(lines, []string{"make", "pwd"})
+
+	lines = nil
+	o.Walk(false, func(line []rune) bool {
+		lines = append(lines, string(line))
+		return true
+	})
+	test.Equal(lines, []string{"ls", "pwd", "make"})
+}
+
+func TestHistoryOnCommit(t *testing.T) {
+	defer test.New(t)
+	var lines []string
+	o := newTestHistory(&Config{OnHistoryCommit: func(line []rune) {
+		lines = append(lines, string(line))
+		line[0] = 'x'
+	}})
+	test.Nil(o.Update([]rune("l"), false))
+	test.Nil(o.New([]rune("ls")))
+	test.Nil(o.New(nil))
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(lines, []string{"ls", "pwd"})
+	test.Equal(rs(o.History()), []string{"ls", "pwd"})
+
+	// the panic is reported by HistoryWarning
+	events := make(chan HistoryEvent, 8)
+	o = newTestHistory(&Config{
+		HistoryEvents:   events,
+		OnHistoryCommit: func([]rune) { panic("oops") },
+	})
+	test.Nil(o.New([]rune("ls")))
+	test.Equal(rs(o.History()), []string{"ls"})
+	var warned bool
+	for len(events) > 0 {
+		if e := <-events; e.Kind == HistoryWarning {
+			warned = true
+			test.Equal(string(e.Line), "ls")
+			test.True(strings.Contains(e.Err.Error(), "oops"))
+		}
+	}
+	test.True(warned)
+}
+
+func benchmarkHistoryLoad(b *testing.B, cfg *Config) {
+	fn := filepath.Join(b.TempDir(), "history")
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(buf, "echo %d\n", i)
+	}
+	cfg.HistoryFile = fn
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// the file is rewritten if it exceeds the limit
+		b.StopTimer()
+		if err := ioutil.WriteFile(fn, buf.Bytes(), 0666); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		o := newOpHistory(cfg)
+		o.Init()
+		o.Close()
+	}
+}
+
+func BenchmarkHistoryLoad(b *testing.B) {
+	benchmarkHistoryLoad(b, &Config{HistoryLimit: 100000})
+}
+
+func BenchmarkHistoryLoadCompact(b *testing.B) {
+	benchmarkHistoryLoad(b, &Config{HistoryLimit: 1000})
+}
+
+func BenchmarkHistoryLoadDryRun(b *testing.B) {
+	benchmarkHistoryLoad(b, &Config{HistoryLimit: 1000, HistoryDryRun: true})
+}
+
+func TestHistoryPushAll(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{HistoryLimit: 3}, "ls\n")
+	defer o.Close()
+	test.Nil(o.Update([]rune("git st"), false))
+	test.Nil(o.PushAll([][]rune{[]rune("a"), nil, []rune("b"), []rune("b")}, true))
+	test.Equal(rs(o.History()), []string{"a", "b", "b"})
+	test.Equal(string(o.editing()), "git st")
+	test.Equal(readTestFile(fn), "ls\na\nb\nb\n")
+
+	test.Nil(o.PushAll([][]rune{[]rune("c")}, false))
+	test.Equal(rs(o.History()), []string{"b", "b", "c"})
+	test.Equal(readTestFile(fn), "ls\na\nb\nb\n")
+}
+
+func benchmarkHistoryLines() [][]rune {
+	lines := make([][]rune, 10000)
+	for i := range lines {
+		lines[i] = []rune(fmt.Sprintf("echo %d", i))
+	}
+	return lines
+}
+
+func BenchmarkHistoryPushAll(b *testing.B) {
+	lines := benchmarkHistoryLines()
+	for i := 0; i < b.N; i++ {
+		o := newTestHistory(&Config{HistoryLimit: 1000})
+		o.PushAll(lines, false)
+	}
+}
+
+func BenchmarkHistoryAdd(b *testing.B) {
+	lines := benchmarkHistoryLines()
+	for i := 0; i < b.N; i++ {
+		o := newTestHistory(&Config{HistoryLimit: 1000})
+		for _, line := range lines {
+			o.Add(line)
+		}
+	}
+}
+
+func BenchmarkHistorySuggest(b *testing.B) {
+	o := newTestHistory(&Config{HistoryNoLimit: true, HistoryDedup: DedupNone})
+	o.PushAll(benchmarkHistoryLines(), false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		o.Suggest([]rune("echo 1"))
+	}
+}
+
+func TestHistoryOrderFunc(t *testing.T) {
+	defer test.New(t)
+	// the longest command is reached first
+	o := newTestHistory(&Config{HistoryOrderFunc: func(entries [][]rune) []int {
+		idx := make([]int, len(entries))
+		for i := range idx {
+			idx[i] = i
+		}
+		sort.SliceStable(idx, func(i, j int) bool {
+			return len(entries[idx[i]]) < len(entries[idx[j]])
+		})
+		return idx
+	}})
+	for _, line := range []string{"make test", "ls", "pwd"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Nil(o.Update([]rune("git"), false))
+	test.Equal(string(o.Prev()), "make test")
+	test.Equal(string(o.Prev()), "pwd")
+	test.Equal(string(o.Prev()), "ls")
+	test.Nil(o.Prev())
+	line, _ := o.Next()
+	test.Equal(string(line), "pwd")
+	o.Next()
+	line, ok := o.Next()
+	test.True(ok)
+	test.Equal(string(line), "git")
+
+	// chronological if it's not a permutation
+	o.cfg.HistoryOrderFunc = func(entries [][]rune) []int { return []int{0, 0} }
+	o.Revert()
+	test.Equal(string(o.Prev()), "pwd")
+}
+
+func TestHistoryCompactOnClose(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistoryLimit: 3, HistoryKeepFileOnLoad: true, HistoryCompactOnClose: true}
+	o, fn := newTestHistoryFile(t, cfg, "a\nb\nb\nc\n")
+	test.Equal(readTestFile(fn), "a\nb\nb\nc\n")
+	test.Nil(o.New([]rune("d")))
+	// appended by another process
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0666)
+	test.Nil(err)
+	f.WriteString("x\n")
+	f.Close()
+	// not by closing it midway, e.g. by CloseHistory
+	o.Close()
+	test.Equal(readTestFile(fn), "a\nb\nb\nc\nd\nx\n")
+	test.Nil(o.Init())
+	o.CloseSession()
+	test.Equal(readTestFile(fn), "c\nd\nx\n")
+}
+
+func TestHistoryEvents(t *testing.T) {
+	defer test.New(t)
+	events := make(chan HistoryEvent, 10)
+	o, _ := newTestHistoryFile(t, &Config{HistoryLimit: 2, HistoryEvents: events}, "ls\npwd\n")
+	defer o.Close()
+	test.Nil(o.Update([]rune("mak"), false))
+	test.Nil(o.New([]rune("make")))
+	test.Nil(o.Clear())
+	close(events)
+
+	var got []HistoryEvent
+	for e := range events {
+		got = append(got, e)
+	}
+	test.Equal(got, []HistoryEvent{
+		{Kind: HistoryEdited, Line: []rune("mak")},
+		{Kind: HistoryAdded, Line: []rune("make"), Seq: 3},
+		{Kind: HistoryEvicted, Line: []rune("ls"), Seq: 1},
+		{Kind: HistoryCleared},
+	})
+
+	// a full channel doesn't block
+	o = newTestHistory(&Config{HistoryEvents: make(chan HistoryEvent)})
+	test.Nil(o.New([]rune("ls")))
+}
+
+func TestHistorySearchIncludeCurrent(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistorySearchIncludeCurrent: true}
+	o := newTestHistory(cfg)
+	test.Nil(o.New([]rune("git status")))
+	test.Nil(o.Update([]rune("git stash"), false))
+	idx, elem := o.FindBck(true, []rune("git st"), 9)
+	test.Equal(idx, 0)
+	test.True(elem == o.history.Back())
+
+	cfg.HistorySearchIncludeCurrent = false
+	idx, elem = o.FindBck(true, []rune("git st"), 9)
+	test.Equal(idx, 0)
+	test.Equal(string(elem.Value.(*hisItem).Source), "git status")
+}
+
+func TestHistoryRelocate(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{}, "ls\n")
+	defer o.Close()
+	dst := filepath.Join(t.TempDir(), "history")
+	test.Nil(o.Relocate(dst))
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(readTestFile(dst), "ls\npwd\n")
+	_, err := os.Stat(fn)
+	test.True(os.IsNotExist(err))
+
+	// copied across the devices
+	renameFile = func(string, string) error {
+		return &os.LinkError{Op: "rename", Err: syscall.EXDEV}
+	}
+	defer func() { renameFile = os.Rename }()
+	test.Nil(o.Relocate(fn))
+	test.Nil(o.New([]rune("make")))
+	test.Equal(readTestFile(fn), "ls\npwd\nmake\n")
+	_, err = os.Stat(dst)
+	test.True(os.IsNotExist(err))
+}
+
+func TestHistoryLiveTmp(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{})
+	for i := 0; i < 100; i++ {
+		test.Nil(o.New([]rune(fmt.Sprintf("echo %d", i))))
+	}
+	edit := func(n int) {
+		test.Nil(o.Update([]rune("git"), false))
+		for i := 0; i < n; i++ {
+			line := o.Prev()
+			test.Nil(o.Update(append(line, '!'), false))
+		}
+	}
+	edit(10)
+	test.Equal(o.liveTmp(), 11)
+	o.Revert()
+	test.Equal(o.liveTmp(), 0)
+
+	edit(10)
+	test.Nil(o.New([]rune("ls")))
+	test.Equal(o.liveTmp(), 0)
+	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+		test.Nil(elem.Value.(*hisItem).Tmp)
+	}
+}
+
+func TestHistoryDryRun(t *testing.T) {
+	defer test.New(t)
+	lines := []string{"ls", "make", "ls", "ls", "pwd", "make", "git st", "ls"}
+	run := func(dryRun bool) ([]string, []string) {
+		events := make(chan HistoryEvent, 100)
+		o := newTestHistory(&Config{
+			HistoryLimit:  3,
+			HistoryDedup:  DedupGlobal,
+			HistoryDryRun: dryRun,
+			HistoryEvents: events,
+		})
+		for _, line := range lines {
+			test.Nil(o.New([]rune(line)))
+		}
+		close(events)
+		var evicted []string
+		for e := range events {
+			if e.Kind == HistoryEvicted {
+				test.Equal(e.DryRun, dryRun)
+				evicted = append(evicted, string(e.Line))
+			}
+		}
+		return evicted, historyLines(o)
+	}
+	evicted, kept := run(false)
+	test.Equal(kept, []string{"make", "git st", "ls"})
+	test.Equal(evicted, []string{"ls", "make", "ls", "pwd"})
+	dryEvicted, all := run(true)
+	test.Equal(dryEvicted, evicted)
+	test.Equal(len(all), len(kept)+len(evicted))
+
+	// HistoryFile isn't rewritten
+	o, fn := newTestHistoryFile(t, &Config{HistoryLimit: 2, HistoryDryRun: true}, "a\nb\nb\nc\n")
+	defer o.Close()
+	test.Equal(readTestFile(fn), "a\nb\nb\nc\n")
+}
+
+func TestHistoryLoad(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{HistoryLimit: 3}, "ls\n")
+	defer o.Close()
+	test.Nil(o.Update([]rune("git"), false))
+	test.Nil(o.Load(strings.NewReader("make\n\npwd")))
+	test.Equal(rs(o.History()), []string{"ls", "make", "pwd"})
+	test.Equal(string(o.editing()), "git")
+	test.Equal(string(o.Prev()), "pwd")
+
+	test.Nil(o.Load(bytes.NewBufferString("cd /\n")))
+	test.Equal(rs(o.History()), []string{"make", "pwd", "cd /"})
+	o.Rewrite()
+	test.Equal(readTestFile(fn), "")
+}
+
+func TestHistoryFindFwd(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{})
+	test.Nil(o.New([]rune("hello world hello")))
+	test.Nil(o.New([]rune("aaa")))
+	test.Nil(o.New([]rune("say hello")))
+	first := o.history.Front()
+
+	ret := []struct {
+		IsNew bool
+		Query string
+		Start int
+		Idx   int
+		Line  string
+	}{
+		{false, "hello", 0, 0, "hello world hello"},
+		{false, "hello", 17, 4, "say hello"},
+		{false, "hello", 12, 12, "hello world hello"},
+		// the first "hello" spans the boundary
+		{false, "hello", 3, 12, "hello world hello"},
+		{false, "hello", 18, 4, "say hello"},
+		// "hell" matched at 12, the cursor is at 16
+		{true, "hello", 16, 12, "hello world hello"},
+		{true, "h", 0, 0, "hello world hello"},
+		{true, "xyz", 0, -1, ""},
+	}
+	for idx, r := range ret {
+		o.current = first
+		i, elem := o.FindFwd(r.IsNew, []rune(r.Query), r.Start)
+		test.Equal(i, r.Idx, fmt.Errorf("%v", idx))
+		if r.Idx >= 0 {
+			test.Equal(string(elem.Value.(*hisItem).Source), r.Line, fmt.Errorf("%v", idx))
+		}
+	}
+
+	// "a" matched at 1 of "aaa", the extended "aa" should stay at 1
+	o.current = first.Next()
+	i, _ := o.FindFwd(true, []rune("aa"), 2)
+	test.Equal(i, 1)
+	i, _ = o.FindBck(true, []rune("aa"), 1)
+	test.Equal(i, 1)
+}
+
+func TestHistorySearchFoldSnapshot(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistorySearchFold: true, HistoryDedupFold: CaseSensitive}
+	o := newTestHistory(cfg)
+	test.Nil(o.New([]rune("say HELLO")))
+	test.Nil(o.New([]rune("say hello")))
+	first := o.history.Front()
+
+	o.current = first
+	i, elem := o.FindFwd(true, []rune("hello"), 0)
+	test.Equal(i, 4)
+	test.Equal(elem, first)
+
+	// the same search keeps the fold it started with
+	cfg.HistorySearchFold = false
+	i, elem = o.FindFwd(false, []rune("hello"), 0)
+	test.Equal(i, 4)
+	test.Equal(elem, first)
+
+	// a new search picks the change up
+	i, elem = o.FindFwd(true, []rune("hello"), 0)
+	test.Equal(i, 4)
+	test.Equal(elem, first.Next())
+}
+
+func TestHistorySearchSessionOnly(t *testing.T) {
+	defer test.New(t)
+	o, _ := newTestHistoryFile(t, &Config{HistorySearchSessionOnly: true}, "make test\n")
+	defer o.Close()
+	idx, elem := o.FindBck(true, []rune("make"), 0)
+	test.Equal(idx, -1)
+	test.Nil(elem)
+
+	test.Nil(o.New([]rune("make build")))
+	idx, elem = o.FindBck(true, []rune("make"), 0)
+	test.Equal(idx, 0)
+	test.Equal(string(elem.Value.(*hisItem).Source), "make build")
+	o.current = elem
+	idx, elem = o.FindBck(false, []rune("make"), 0)
+	test.Equal(idx, -1)
+
+	// loaded history is still navigable
+	o.current = o.history.Back()
+	o.Prev()
+	test.Equal(string(o.Prev()), "make test")
+}
+
+func TestHistorySearchPrefix(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistorySearchPrefix: true, HistorySearchFold: true})
+	for _, line := range []string{"git status", "ls", "GIT log", "make"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Nil(o.Update([]rune("git"), false))
+	test.Equal(string(o.Prev()), "GIT log")
+	test.Equal(string(o.Prev()), "git status")
+	test.Nil(o.Prev())
+	line, ok := o.Next()
+	test.True(ok)
+	test.Equal(string(line), "GIT log")
+	line, ok = o.Next()
+	test.True(ok)
+	test.Equal(string(line), "git")
+	_, ok = o.Next()
+	test.False(ok)
+
+	// walk through all the commands without a prefix
+	o.Revert()
+	test.Equal(string(o.Prev()), "make")
+	test.Equal(string(o.Prev()), "GIT log")
+}
+
+func TestHistoryRevertEdit(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{})
+	for _, line := range []string{"ls", "pwd"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	// edits on several entries are kept while editing the same line
+	test.Equal(string(o.Prev()), "pwd")
+	test.Nil(o.Update([]rune("pwd -P"), false))
+	test.Equal(string(o.Prev()), "ls")
+	test.Nil(o.Update([]rune("ls -l"), false))
+	line, _ := o.Next()
+	test.Equal(string(line), "pwd -P")
+
+	// and dropped once the line is reverted
+	o.Revert()
+	test.Equal(string(o.Prev()), "pwd")
+	test.Equal(string(o.Prev()), "ls")
+
+	// or submitted
+	test.Nil(o.Update([]rune("ls -a"), false))
+	o.Revert()
+	test.Nil(o.New([]rune("whoami")))
+	test.Equal(string(o.Prev()), "whoami")
+	test.Equal(string(o.Prev()), "pwd")
+	test.Equal(string(o.Prev()), "ls")
+}
+
+func TestHistoryLineEnding(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{HistoryLineEnding: "\r\n"}, "ls\r\npwd\n")
+	test.Equal(rs(o.History()), []string{"ls", "pwd"})
+	test.Nil(o.New([]rune("echo a\necho b")))
+	o.Close()
+	test.Equal(readTestFile(fn), "ls\r\npwd\necho a echo b\r\n")
+
+	o, _ = newTestHistoryFile(t, &Config{}, readTestFile(fn))
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"ls", "pwd", "echo a echo b"})
+}
+
+func TestHistoryNoTrim(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistoryNoTrim: true}
+	o, fn := newTestHistoryFile(t, cfg, "")
+	test.Nil(o.New([]rune("echo hi  ")))
+	o.Close()
+	test.Equal(readTestFile(fn), "echo hi  \n")
+
+	o = newOpHistory(cfg)
+	o.Init()
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"echo hi  "})
+}
+
+func TestHistoryMaxBytes(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistoryMaxBytes: 10, HistoryLoadRotated: true}
+	o, fn := newTestHistoryFile(t, cfg, "")
+	test.Nil(o.New([]rune("echo 1234")))
+	test.Equal(readTestFile(fn), "echo 1234\n")
+	test.Nil(o.New([]rune("ls")))
+	test.Equal(readTestFile(fn), "")
+	test.Equal(readTestFile(fn+".1"), "echo 1234\nls\n")
+	test.Nil(o.New([]rune("pwd")))
+	o.Close()
+	test.Equal(readTestFile(fn), "pwd\n")
+
+	o = newOpHistory(cfg)
+	o.Init()
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"echo 1234", "ls", "pwd"})
+
+	// the newest rotated one is loaded anyway
+	o, fn = newTestHistoryFile(t, &Config{HistoryMaxBytes: 5, HistoryRotateCount: 2}, "")
+	for _, line := range []string{"ls -l", "pwd", "make", "git"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	o.Close()
+	test.Equal(readTestFile(fn), "git\n")
+	o = newOpHistory(o.cfg)
+	o.Init()
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"pwd", "make", "git"})
+
+	// the rotated ones are shifted
+	cfg = &Config{HistoryMaxBytes: 5, HistoryRotateCount: 2, HistoryLoadRotated: true}
+	o, fn = newTestHistoryFile(t, cfg, "")
+	for _, line := range []string{"ls -l", "pwd", "make", "git", "cd"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	o.Close()
+	// rotated three times, "ls -l" is the oldest one dropped
+	test.Equal(readTestFile(fn), "")
+	test.Equal(readTestFile(fn+".1"), "git\ncd\n")
+	test.Equal(readTestFile(fn+".2"), "pwd\nmake\n")
+	_, err := os.Stat(fn + ".3")
+	test.True(os.IsNotExist(err))
+	o = newOpHistory(cfg)
+	o.Init()
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"pwd", "make", "git", "cd"})
+}
+
+func TestHistorySanitize(t *testing.T) {
+	defer test.New(t)
+	re := regexp.MustCompile(`--token=\S+`)
+	cfg := &Config{HistorySanitize: func(line []rune) []rune {
+		if strings.HasPrefix(string(line), "secret") {
+			return nil
+		}
+		return []rune(re.ReplaceAllString(string(line), "--token=***"))
+	}}
+	o, fn := newTestHistoryFile(t, cfg, "")
+	test.Nil(o.New([]rune("login --token=abc")))
+	test.Nil(o.New([]rune("secret")))
+	o.Close()
+	test.Equal(readTestFile(fn), "login --token=***\n")
+	test.Equal(rs(o.History()), []string{"login --token=abc"})
+
+	cfg.HistorySanitizeMemory = true
+	o = newTestHistory(cfg)
+	test.Nil(o.New([]rune("login --token=abc")))
+	test.Equal(rs(o.History()), []string{"login --token=***"})
+}
+
+func TestHistoryUnwritable(t *testing.T) {
+	defer test.New(t)
+	fn := filepath.Join(t.TempDir(), "missing", "history")
+	o := newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 500})
+	err := o.Init()
+	test.True(strings.Contains(err.Error(), fn))
+	test.True(errors.Is(err, ErrHistoryLoad))
+	test.True(errors.Is(err, os.ErrNotExist))
+	test.False(errors.Is(err, ErrHistoryAppend))
+
+	// the corrupted gzip
+	o, fn = newTestHistoryFile(t, &Config{HistoryCompress: true}, "ls\n")
+	test.True(errors.Is(o.Init(), ErrHistoryLoad))
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(rs(o.History()), []string{"pwd"})
+	test.Equal(readTestFile(fn), "ls\n")
+
+	o = newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 500, HistoryFallbackMemory: true})
+	test.Nil(o.Init())
+	test.Nil(o.New([]rune("ls")))
+	test.Equal(rs(o.History()), []string{"ls"})
+
+	// the file gone under Reload, and the closed fd under Flush and Clear
+	o, fn = newTestHistoryFile(t, &Config{HistoryFlushCount: 10}, "ls\n")
+	test.Nil(os.Remove(fn))
+	test.True(errors.Is(o.Reload(), ErrHistoryLoad))
+	test.Nil(o.New([]rune("pwd")))
+	o.fd.Close()
+	test.True(errors.Is(o.Flush(), ErrHistoryAppend))
+	test.True(errors.Is(o.Clear(), ErrHistoryAppend))
+
+	// the flush timer reports it by HistoryWarning
+	events := make(chan HistoryEvent, 8)
+	o, _ = newTestHistoryFile(t, &Config{HistoryFlushInterval: time.Millisecond, HistoryEvents: events}, "")
+	o.fd.Close()
+	test.Nil(o.New([]rune("ls")))
+	for e := range events {
+		if e.Kind == HistoryWarning {
+			test.True(errors.Is(e.Err, ErrHistoryAppend))
+			break
+		}
+	}
+}
+
+func TestHistoryExtraFiles(t *testing.T) {
+	defer test.New(t)
+	global := filepath.Join(t.TempDir(), "global")
+	test.Nil(ioutil.WriteFile(global, []byte("ls\npwd\n"), 0666))
+	// the duplicated line makes the file rewritten
+	o, fn := newTestHistoryFile(t, &Config{HistoryExtraFiles: []string{global}}, "make\nmake\n")
+	test.Equal(rs(o.History()), []string{"ls", "pwd", "make"})
+	test.Nil(o.New([]rune("go test")))
+	o.Close()
+	test.Equal(readTestFile(fn), "make\ngo test\n")
+	test.Equal(readTestFile(global), "ls\npwd\n")
+}
+
+func TestHistorySkipBlank(t *testing.T) {
+	defer test.New(t)
+	o, _ := newTestHistoryFile(t, &Config{HistoryNoTrim: true}, "ls\n   \npwd\n")
+	defer o.Close()
+	test.Equal(len(o.History()), 3)
+	test.Equal(string(o.Prev()), "pwd")
+	test.Equal(string(o.Prev()), "ls")
+	next, _ := o.Next()
+	test.Equal(string(next), "pwd")
+
+	o.Revert()
+	o.cfg.HistoryKeepBlank = true
+	test.Equal(string(o.Prev()), "pwd")
+	test.Equal(string(o.Prev()), "   ")
+}
+
+func TestHistoryMultiline(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistoryMultiline: true}
+	o, fn := newTestHistoryFile(t, cfg, "")
+	test.Nil(o.New([]rune("cat <<EOF\nhello\nEOF")))
+	test.Nil(o.New([]rune(`printf "a\nb"`)))
+	o.Close()
+	test.Equal(readTestFile(fn), "#readline:multiline\n"+`cat <<EOF\nhello\nEOF`+"\n"+`printf "a\\nb"`+"\n")
+
+	o = newOpHistory(cfg)
+	o.Init()
+	test.Equal(rs(o.History()), []string{"cat <<EOF\nhello\nEOF", `printf "a\nb"`})
+	test.Equal(string(o.Prev()), `printf "a\nb"`)
+	test.Equal(string(o.Prev()), "cat <<EOF\nhello\nEOF")
+	o.Close()
+
+	// the file written without it isn't decoded, it's rewritten escaped
+	o, fn = newTestHistoryFile(t, cfg, `printf "a\nb"`+"\n")
+	test.Equal(rs(o.History()), []string{`printf "a\nb"`})
+	test.Nil(o.New([]rune("echo 1\necho 2")))
+	o.Close()
+	test.Equal(readTestFile(fn), "#readline:multiline\n"+`printf "a\\nb"`+"\n"+`echo 1\necho 2`+"\n")
+	o = newOpHistory(cfg)
+	o.Init()
+	test.Equal(rs(o.History()), []string{`printf "a\nb"`, "echo 1\necho 2"})
+	o.Close()
+
+	// or kept as is, so a newline is still saved as a space
+	keep := &Config{HistoryMultiline: true, HistoryKeepFileOnLoad: true}
+	o, fn = newTestHistoryFile(t, keep, `printf "a\nb"`+"\n")
+	test.Nil(o.New([]rune("echo 1\necho 2")))
+	o.Close()
+	test.Equal(readTestFile(fn), `printf "a\nb"`+"\n"+"echo 1 echo 2\n")
+
+	// the file of comments only is marked before the first command
+	o, fn = newTestHistoryFile(t, &Config{HistoryMultiline: true, HistoryCommentPrefix: "#"}, "# v1\n")
+	test.Nil(o.New([]rune("echo 1\necho 2")))
+	o.Close()
+	test.Equal(readTestFile(fn), "# v1\n#readline:multiline\n"+`echo 1\necho 2`+"\n")
+
+	// so is the new file by rotating
+	o, fn = newTestHistoryFile(t, &Config{HistoryMultiline: true, HistoryMaxBytes: 30}, "")
+	test.Nil(o.New([]rune("echo 1\necho 2")))
+	test.Nil(o.New([]rune("ls")))
+	o.Close()
+	test.Equal(readTestFile(fn+".1"), "#readline:multiline\n"+`echo 1\necho 2`+"\n")
+	test.Equal(readTestFile(fn), "#readline:multiline\nls\n")
+
+	// the exported text carries the marker for importing
+	o = newTestHistory(cfg)
+	test.Nil(o.New([]rune("echo 1\necho 2")))
+	var buf bytes.Buffer
+	test.Nil(o.Export(&buf, HistoryFormatText))
+	test.Equal(buf.String(), "#readline:multiline\n"+`echo 1\necho 2`+"\n")
+	o = newTestHistory(cfg)
+	test.Nil(o.Import(&buf, HistoryFormatText))
+	test.Equal(rs(o.History()), []string{"echo 1\necho 2"})
+	test.Nil(o.Import(strings.NewReader(`printf "a\nb"`+"\n"), HistoryFormatText))
+	test.Equal(rs(o.History()), []string{"echo 1\necho 2", `printf "a\nb"`})
+}
+
+func TestHistoryFlush(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{HistoryFlushCount: 2}, "")
+	test.Nil(o.New([]rune("ls")))
+	test.Equal(readTestFile(fn), "")
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(readTestFile(fn), "ls\npwd\n")
+	test.Nil(o.New([]rune("whoami")))
+	test.Nil(o.Flush())
+	test.Equal(readTestFile(fn), "ls\npwd\nwhoami\n")
+	test.Nil(o.New([]rune("make")))
+	o.Close()
+	test.Equal(readTestFile(fn), "ls\npwd\nwhoami\nmake\n")
+
+	o, fn = newTestHistoryFile(t, &Config{HistoryFlushInterval: 10 * time.Millisecond}, "")
+	defer o.Close()
+	test.Nil(o.New([]rune("ls")))
+	test.Equal(readTestFile(fn), "")
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(readTestFile(fn), "ls\n")
+}
+
+func TestHistoryReloadLikeInit(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistorySkipGarbage: true, HistoryDedup: DedupGlobal}
+	o, fn := newTestHistoryFile(t, cfg, "ls\npwd\n")
+	defer o.Close()
+	long := strings.Repeat("x", 100000)
+	appendTestFile(fn, "\x00\x00\nls\n"+long+"\n")
+	test.Nil(o.Reload())
+	test.Equal(historyLines(o), []string{"pwd", "ls", long})
+
+	test.Nil(o.Import(strings.NewReader("\x01\x02\npwd\n"+long+"\n"), HistoryFormatText))
+	test.Equal(historyLines(o), []string{"ls", "pwd", long})
+	test.Equal(readTestFile(fn), "ls\npwd\n\x00\x00\nls\n"+long+"\npwd\n"+long+"\n")
+
+	entries, err := MergeHistoryFiles([]string{fn}, 1)
+	test.Nil(err)
+	test.Equal(string(entries[0].Line), long)
+
+	// the commands by others are paired with their metadata
+	cfg = &Config{HistorySidecar: true, HistoryRecordDir: true, FuncGetDir: func() string { return "/a" }}
+	o, fn = newTestHistoryFile(t, cfg, "")
+	defer o.Close()
+	test.Nil(o.New([]rune("ls")))
+	other := newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 500, HistorySidecar: true,
+		HistoryRecordDir: true, FuncGetDir: func() string { return "/b" }})
+	test.Nil(other.Init())
+	test.Nil(other.New([]rune("make")))
+	other.Close()
+	test.Nil(o.New([]rune("pwd")))
+	test.Nil(o.Reload())
+	entries = o.Entries()
+	test.Equal(len(entries), 3)
+	test.Equal(string(entries[2].Line), "make")
+	test.Equal(entries[2].Dir, "/b")
+}
+
+func TestHistoryReload(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{}, "ls\n")
+	defer o.Close()
+	test.Nil(o.New([]rune("pwd")))
+	test.Nil(o.Update([]rune("ec"), false))
+
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0666)
+	test.Nil(err)
+	_, err = f.WriteString("make\nmake te")
+	test.Nil(err)
+	test.Nil(o.Reload())
+	test.Equal(rs(o.History()), []string{"ls", "pwd", "make"})
+
+	_, err = f.WriteString("st\n")
+	test.Nil(err)
+	f.Close()
+	test.Nil(o.Reload())
+	test.Equal(rs(o.History()), []string{"ls", "pwd", "make", "make test"})
+	test.Equal(string(o.showItem(o.current.Value)), "ec")
+}
+
+func TestHistoryLimit(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{HistoryLimit: 3}, "a\nb\nc\n")
+	defer o.Close()
+	test.Nil(o.Update([]rune("d"), false))
+	for _, line := range []string{"c", "b", "a"} {
+		test.Equal(string(o.Prev()), line)
+	}
+	test.Nil(o.Prev())
+	test.Equal(readTestFile(fn), "a\nb\nc\n")
+
+	o.Revert()
+	test.Nil(o.New([]rune("d")))
+	test.Equal(rs(o.History()), []string{"b", "c", "d"})
+}
+
+func TestHistoryKeepFileOnLoad(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{HistoryLimit: 2, HistoryKeepFileOnLoad: true}, "a\nb\nb\nc\n")
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"b", "c"})
+	test.Equal(readTestFile(fn), "a\nb\nb\nc\n")
+
+	test.Nil(o.New([]rune("d")))
+	test.Equal(readTestFile(fn), "a\nb\nb\nc\nd\n")
+}
+
+func TestHistoryNoLimit(t *testing.T) {
+	defer test.New(t)
+	fn := filepath.Join(t.TempDir(), "history")
+	test.Nil(ioutil.WriteFile(fn, []byte("a\nb\nc\n"), 0666))
+	o := newOpHistory(&Config{HistoryFile: fn})
+	test.Nil(o.Init())
+	defer o.Close()
+	test.Nil(o.New([]rune("d")))
+	test.Equal(rs(o.History()), []string{"a", "b", "c", "d"})
+	test.Equal(readTestFile(fn), "a\nb\nc\nd\n")
+
+	// HistoryNoLimit keeps them all over HistoryLimit, -1 still disables history
+	o = newTestHistory(&Config{HistoryLimit: 2, HistoryNoLimit: true})
+	for _, line := range []string{"a", "b", "c"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(rs(o.History()), []string{"a", "b", "c"})
+	o = newTestHistory(&Config{HistoryLimit: -1})
+	test.Nil(o.New([]rune("secret")))
+	test.Equal(len(o.History()), 0)
+}
+
+func TestHistoryReopenOnMissing(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{HistoryReopenOnMissing: true}, "ls\n")
+	defer o.Close()
+	test.Nil(os.Rename(fn, fn+".1"))
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(readTestFile(fn), "pwd\n")
+	test.Equal(readTestFile(fn+".1"), "ls\n")
+
+	test.Nil(os.Remove(fn))
+	test.Nil(o.New([]rune("make")))
+	test.Equal(readTestFile(fn), "make\n")
+}
+
+func TestMergeHistoryFiles(t *testing.T) {
+	defer test.New(t)
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	c := filepath.Join(dir, "c")
+	test.Nil(ioutil.WriteFile(a, []byte("#100\nls\n#300\nmake\npwd\n"), 0666))
+	test.Nil(ioutil.WriteFile(b, []byte("#200\nls\n#400\ngo test\n"), 0666))
+	// without timestamp
+	test.Nil(ioutil.WriteFile(c, []byte("echo 1\necho 2\n"), 0666))
+
+	entries, err := MergeHistoryFiles([]string{a, b, c}, 0)
+	test.Nil(err)
+	var lines []string
+	for _, e := range entries {
+		lines = append(lines, string(e.Line))
+	}
+	test.Equal(lines, []string{"echo 1", "echo 2", "ls", "make", "pwd", "go test"})
+	test.Equal(entries[2].Time.Unix(), int64(200))
+
+	entries, err = MergeHistoryFiles([]string{a, b}, 2)
+	test.Nil(err)
+	test.Equal(len(entries), 2)
+	test.Equal(string(entries[0].Line), "pwd")
+
+	_, err = MergeHistoryFiles([]string{filepath.Join(dir, "missing")}, 0)
+	test.True(errors.Is(err, ErrHistoryLoad))
+}
+
+func TestHistoryReadOnly(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistoryReadOnly: true, HistoryLimit: 1, HistoryFileLock: true}
+	o, fn := newTestHistoryFile(t, cfg, "ls\npwd\n")
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"pwd"})
+	test.Nil(o.New([]rune("make")))
+	test.Equal(rs(o.History()), []string{"make"})
+	test.Equal(string(o.Prev()), "make")
+	test.Equal(o.Clear(), ErrHistoryReadOnly)
+	test.Equal(readTestFile(fn), "ls\npwd\n")
+	_, err := os.Stat(fn + ".lock")
+	test.True(os.IsNotExist(err))
+
+	// it isn't created
+	fn = filepath.Join(t.TempDir(), "history")
+	o = newOpHistory(&Config{HistoryFile: fn, HistoryReadOnly: true, HistoryLimit: 500})
+	test.Nil(o.Init())
+	test.Nil(o.New([]rune("ls")))
+	_, err = os.Stat(fn)
+	test.True(os.IsNotExist(err))
+}
+
+func TestHistoryCompactCurrent(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryLimit: 3})
+	for _, line := range []string{"a", "b", "c"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	for range []string{"c", "b", "a"} {
+		o.Prev()
+	}
+	test.Nil(o.Import(strings.NewReader("d\ne\n"), HistoryFormatText))
+	test.Equal(rs(o.History()), []string{"c", "d", "e"})
+	test.Equal(string(o.showItem(o.current.Value)), "c")
+	next, ok := o.Next()
+	test.True(ok)
+	test.Equal(string(next), "d")
+
+	// committing moves to the end first
+	o.Revert()
+	for range []string{"e", "d", "c"} {
+		// the buffer is saved after each key, as Operation does
+		test.Nil(o.Update(o.Prev(), false))
+	}
+	for _, line := range []string{"c", "g", "h"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Equal(rs(o.History()), []string{"c", "g", "h"})
+	test.True(o.current == o.history.Back())
+}
+
+func TestHistoryFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no permission bits on windows")
+	}
+	defer test.New(t)
+	fn := filepath.Join(t.TempDir(), "history")
+	o := newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 2, HistoryFileMode: 0600})
+	test.Nil(o.Init())
+	fi, err := os.Stat(fn)
+	test.Nil(err)
+	test.Equal(fi.Mode().Perm(), os.FileMode(0600))
+
+	o.Rewrite()
+	o.Close()
+	fi, err = os.Stat(fn)
+	test.Nil(err)
+	test.Equal(fi.Mode().Perm(), os.FileMode(0600))
+}
+
+func TestHistoryFileLock(t *testing.T) {
+	switch runtime.GOOS {
+	case "aix", "solaris":
+		t.Skip("no advisory locking")
+	}
+	defer test.New(t)
+	fn := filepath.Join(t.TempDir(), "history")
+	newHistory := func() *opHistory {
+		o := newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 500, HistoryFileLock: true, HistoryFileMode: 0600})
+		test.Nil(o.Init())
+		return o
+	}
+	a, b := newHistory(), newHistory()
+	defer a.Close()
+	defer b.Close()
+
+	// b waits for a to release the lock before saving
+	unlock := a.lockHistoryFile()
+	done := make(chan error)
+	go func() { done <- b.New([]rune("ls")) }()
+	select {
+	case err := <-done:
+		t.Fatal("saved while the lock is held, got", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	test.Equal(readTestFile(fn), "")
+	unlock()
+	test.Nil(<-done)
+	test.Equal(readTestFile(fn), "ls\n")
+
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(fn + ".lock")
+		test.Nil(err)
+		test.Equal(fi.Mode().Perm(), os.FileMode(0600))
+	}
+}
+
+func newTestCipher(key string) cipher.AEAD {
+	block, err := aes.NewCipher([]byte(key))
+	test.Nil(err)
+	aead, err := cipher.NewGCM(block)
+	test.Nil(err)
+	return aead
+}
+
+func TestHistoryCipher(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistoryCipher: newTestCipher("0123456789abcdef")}
+	o, fn := newTestHistoryFile(t, cfg, "")
+	test.Nil(o.New([]rune("export TOKEN=secret")))
+	o.Close()
+	data := readTestFile(fn)
+	test.False(strings.Contains(data, "secret"))
+
+	o = newOpHistory(cfg)
+	test.Nil(o.Init())
+	test.Equal(rs(o.History()), []string{"export TOKEN=secret"})
+	o.Close()
+
+	o = newOpHistory(&Config{
+		HistoryFile:   fn,
+		HistoryLimit:  500,
+		HistoryCipher: newTestCipher("fedcba9876543210"),
+	})
+	err := o.Init()
+	test.True(errors.Is(err, ErrHistoryDecrypt))
+	test.True(errors.Is(err, ErrHistoryLoad))
+	test.Nil(o.New([]rune("ls")))
+	test.Equal(readTestFile(fn), data)
+
+	// retried after failing in the middle
+	o, fn = newTestHistoryFile(t, cfg, "")
+	test.Nil(o.New([]rune("a")))
+	test.Nil(o.New([]rune("b")))
+	o.Close()
+	appendTestFile(fn, "garbage\n")
+	o = newOpHistory(cfg)
+	test.True(errors.Is(o.Init(), ErrHistoryDecrypt))
+	test.Nil(o.New([]rune("ls")))
+	test.True(errors.Is(o.Init(), ErrHistoryDecrypt))
+	test.Equal(historyLines(o), []string{"a", "b", "ls"})
+
+	// the failure of generating the nonce is returned rather than panicking
+	o, fn = newTestHistoryFile(t, cfg, "")
+	randRead = func([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
+	defer func() { randRead = rand.Read }()
+	err = o.New([]rune("ls"))
+	test.True(errors.Is(err, ErrHistoryAppend))
+	test.True(errors.Is(err, io.ErrUnexpectedEOF))
+	o.Close()
+	test.Equal(readTestFile(fn), "")
+}
+
+func TestHistoryInitRetry(t *testing.T) {
+	defer test.New(t)
+	dir := filepath.Join(t.TempDir(), "missing")
+	fn := filepath.Join(dir, "history")
+	o := newOpHistory(&Config{HistoryFile: fn})
+	test.NotNil(o.Init())
+	test.Nil(o.New([]rune("s1")))
+	test.Nil(o.New([]rune("s2")))
+	test.Nil(os.Mkdir(dir, 0755))
+	test.Nil(ioutil.WriteFile(fn, []byte("old1\nold2\nold3\n"), 0666))
+	test.Nil(o.Init())
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"old1", "old2", "old3", "s1", "s2"})
+	for i, line := range []string{"old1", "old2", "old3", "s1", "s2"} {
+		got, ok := o.ByNumber(o.seq - 4 + i)
+		test.True(ok)
+		test.Equal(string(got), line)
+	}
+	var buf bytes.Buffer
+	test.Nil(o.Dump(&buf, true))
+	test.Equal(buf.String(), "    3  old1\n    4  old2\n    5  old3\n    6  s1\n    7  s2\n")
+}
+
+func TestHistoryReopen(t *testing.T) {
+	defer test.New(t)
+	o, fn := newTestHistoryFile(t, &Config{}, "ls\n")
+	defer o.Close()
+	o.Close()
+	test.True(o.IsHistoryClosed())
+	test.Nil(o.New([]rune("export TOKEN=secret")))
+
+	test.Nil(o.Init())
+	test.Nil(o.Init())
+	test.False(o.IsHistoryClosed())
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(rs(o.History()), []string{"ls", "export TOKEN=secret", "pwd"})
+	test.Equal(readTestFile(fn), "ls\npwd\n")
+}
+
+func TestHistoryWrap(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryWrap: true})
+	for _, line := range []string{"a", "b", "c"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	test.Nil(o.Update([]rune("ed"), false))
+	for _, line := range []string{"c", "b", "a", "c", "b", "a", "c"} {
+		test.Equal(string(o.Prev()), line)
+	}
+	for _, line := range []string{"ed", "a", "b", "c", "ed", "a"} {
+		ret, ok := o.Next()
+		test.True(ok)
+		test.Equal(string(ret), line)
+	}
+}
+
+func TestHistoryShrinkPolicy(t *testing.T) {
+	defer test.New(t)
+	const content = "a\nb\nc\nd\n"
+	o, fn := newTestHistoryFile(t, &Config{HistoryLimit: 2}, content)
+	test.Equal(historyLines(o), []string{"c", "d"})
+	test.Equal(readTestFile(fn), "c\nd\n")
+	o.Close()
+
+	o, fn = newTestHistoryFile(t, &Config{HistoryLimit: 2, HistoryShrinkPolicy: ShrinkMemoryOnly}, content)
+	test.Equal(historyLines(o), []string{"c", "d"})
+	test.Equal(readTestFile(fn), content)
+	o.Close()
+
+	o, fn = newTestHistoryFile(t, &Config{HistoryLimit: 2, HistoryShrinkPolicy: ShrinkArchive}, content)
+	test.Equal(historyLines(o), []string{"c", "d"})
+	test.Equal(readTestFile(fn), "c\nd\n")
+	test.Equal(readTestFile(fn+".archive"), "a\nb\n")
+	o.Close()
+}
+
+func TestHistoryCompactFile(t *testing.T) {
+	defer test.New(t)
+	test.Nil(newTestHistory(&Config{}).CompactFile())
+
+	cfg := &Config{HistoryLimit: 4}
+	o, fn := newTestHistoryFile(t, cfg, "ls\npwd\nls\n")
+	defer o.Close()
+	test.Nil(o.New([]rune("make")))
+	cfg.HistoryLimit = 2
+	o.Trim()
+	test.Equal(historyLines(o), []string{"ls", "make"})
+	test.Equal(readTestFile(fn), "ls\npwd\nls\nmake\n")
+
+	test.Nil(o.CompactFile())
+	test.Equal(readTestFile(fn), "ls\nmake\n")
+	test.Nil(o.New([]rune("pwd")))
+	test.Equal(readTestFile(fn), "ls\nmake\npwd\n")
+
+	// appended by others after compacting
+	test.Nil(o.CompactFile())
+	appendTestFile(fn, "other-three\n")
+	test.Nil(o.Reload())
+	test.Equal(historyLines(o), []string{"pwd", "other-three"})
+}
+
+func TestHistoryByNumber(t *testing.T) {
+	defer test.New(t)
+	o := newTestHistory(&Config{HistoryLimit: 3})
+	for _, line := range []string{"a", "b", "c", "d", "e"} {
+		test.Nil(o.New([]rune(line)))
+	}
+	for n := 0; n <= 2; n++ {
+		_, ok := o.ByNumber(n)
+		test.False(ok)
+	}
+	for n, line := range map[int]string{3: "c", 4: "d", 5: "e"} {
+		ret, ok := o.ByNumber(n)
+		test.True(ok)
+		test.Equal(string(ret), line)
+	}
+	_, ok := o.ByNumber(6)
+	test.False(ok)
+
+	test.Nil(o.New([]rune("f")))
+	_, ok = o.ByNumber(3)
+	test.False(ok)
+	ret, ok := o.ByNumber(6)
+	test.True(ok)
+	test.Equal(string(ret), "f")
+}
+
+func TestHistoryBestEffort(t *testing.T) {
+	defer test.New(t)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(gz, "echo %d\n", i)
+	}
+	test.Nil(gz.Close())
+	// cut by a crash
+	data := buf.Bytes()[:buf.Len()/2]
+	fn := filepath.Join(t.TempDir(), "history.gz")
+
+	test.Nil(ioutil.WriteFile(fn, data, 0666))
+	o := newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 2000})
+	test.True(errors.Is(o.Init(), ErrHistoryLoad))
+	o.Close()
+
+	o = newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 2000, HistoryBestEffort: true})
+	test.Equal(o.Init(), ErrHistoryTruncated)
+	lines := rs(o.History())
+	test.True(len(lines) > 0 && len(lines) < 1000)
+	for i, line := range lines {
+		test.Equal(line, fmt.Sprintf("echo %d", i))
+	}
+	test.Nil(o.New([]rune("ls")))
+	o.Close()
+
+	// it's rewritten with the loaded commands
+	o = newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 2000})
+	test.Nil(o.Init())
+	defer o.Close()
+	test.Equal(rs(o.History()), append(lines, "ls"))
+}
+
+func TestHistorySidecar(t *testing.T) {
+	defer test.New(t)
+	dir := "/home/a"
+	cfg := &Config{HistorySidecar: true, HistoryRecordDir: true, FuncGetDir: func() string { return dir }}
+	o, fn := newTestHistoryFile(t, cfg, "")
+	test.Nil(o.New([]rune("make")))
+	dir = "/tmp"
+	test.Nil(o.New([]rune("pwd")))
+	o.Close()
+	test.Equal(readTestFile(fn), "make\npwd\n")
+	test.Equal(strings.Count(readTestFile(fn+".meta"), "\n"), 2)
+
+	o = newOpHistory(cfg)
+	test.Nil(o.Init())
+	entries := o.Entries()
+	test.Equal(len(entries), 2)
+	test.Equal(entries[0].Dir, "/home/a")
+	test.Equal(entries[1].Dir, "/tmp")
+	test.False(entries[1].Time.IsZero())
+	o.Close()
+
+	// appended by bash, the rest are loaded without the metadata
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0666)
+	test.Nil(err)
+	_, err = f.WriteString("ls\n")
+	test.Nil(err)
+	f.Close()
+	events := make(chan HistoryEvent, 8)
+	cfg.HistoryEvents = events
+	o = newOpHistory(cfg)
+	test.Nil(o.Init())
+	cfg.HistoryEvents = nil
+	test.Equal(len(events), 1)
+	test.Equal((<-events).Err, ErrHistorySidecarSync)
+	entries = o.Entries()
+	test.Equal(len(entries), 3)
+	test.Equal(entries[1].Dir, "/tmp")
+	test.Equal(string(entries[2].Line), "ls")
+	test.Equal(entries[2].Dir, "")
+	o.Close()
+	// it's rewritten in sync
+	test.Equal(readTestFile(fn), "make\npwd\nls\n")
+	test.Equal(strings.Count(readTestFile(fn+".meta"), "\n"), 3)
+
+	// the missing sidecar
+	test.Nil(os.Remove(fn + ".meta"))
+	o = newOpHistory(cfg)
+	test.Nil(o.Init())
+	defer o.Close()
+	test.Equal(rs(o.History()), []string{"make", "pwd", "ls"})
+	test.Equal(o.Entries()[0].Dir, "")
+}
+
+func TestHistoryNoBlankCommit(t *testing.T) {
+	defer test.New(t)
+	events := make(chan HistoryEvent, 16)
+	cfg := &Config{HistoryEvents: events, HistoryNoTrim: true}
+	o, fn := newTestHistoryFile(t, cfg, "")
+	defer o.Close()
+	test.Nil(o.New(nil))
+	test.Nil(o.New([]rune("   ")))
+	test.Nil(o.Update([]rune("\t"), true))
+	test.Nil(o.Add([]rune(" ")))
+	test.Nil(o.New([]rune("ls")))
+	// recall an item without editing it
+	o.Prev()
+	test.Nil(o.Update([]rune(" "), false))
+	test.Nil(o.New(nil))
+	test.Nil(o.New([]rune("pwd")))
+
+	test.Equal(readTestFile(fn), "ls\npwd\n")
+	test.Equal(historyLines(o), []string{"ls", "pwd"})
+	test.False(o.isSentinel(o.history.Back().Prev()))
+	close(events)
+	var added []string
+	for e := range events {
+		if e.Kind == HistoryAdded {
+			added = append(added, string(e.Line))
+		}
+	}
+	test.Equal(added, []string{"ls", "pwd"})
+
+	// nor saved by the batch ones
+	o, fn = newTestHistoryFile(t, &Config{HistoryNoTrim: true}, "")
+	defer o.Close()
+	test.Nil(o.PushAll([][]rune{[]rune("ls"), []rune("  ")}, true))
+	test.Nil(o.Import(strings.NewReader(`{"line":"\t"}`+"\n"+`{"line":"pwd"}`), HistoryFormatJSON))
+	test.Equal(readTestFile(fn), "ls\npwd\n")
+}
+
+func TestHistoryAuditor(t *testing.T) {
+	defer test.New(t)
+	var buf bytes.Buffer
+	audit := NewHistoryAuditor(&buf, func(r AuditRecord) string {
+		return fmt.Sprintf("pid=%d cmd=%q\n", r.Pid, string(r.Line))
+	})
+	o := newTestHistory(&Config{OnHistoryCommit: audit})
+	test.Nil(o.New([]rune("ls")))
+	test.Nil(o.New([]rune("make\ntest")))
+	pid := os.Getpid()
+	test.Equal(buf.String(), fmt.Sprintf("pid=%d cmd=\"ls\"\npid=%d cmd=\"make\\ntest\"\n", pid, pid))
+	// still navigable
+	test.Equal(string(o.Prev()), "make\ntest")
+
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	line := FormatAuditRecord(AuditRecord{Line: []rune("make\ntest"), Time: ts, Pid: 42, User: "alice"})
+	test.Equal(line, "2024-01-02T03:04:05Z alice[42]: make test\n")
+}
+
+func TestHistoryCloseRace(t *testing.T) {
+	defer test.New(t)
+	for i := 0; i < 20; i++ {
+		o, fn := newTestHistoryFile(t, &Config{}, "")
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				test.Nil(o.New([]rune(fmt.Sprintf("echo %d", j))))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			o.Close()
+		}()
+		wg.Wait()
+		// the commands after closing are kept in memory only
+		test.True(o.IsHistoryClosed())
+		test.Equal(len(o.History()), 20)
+		test.True(strings.Count(readTestFile(fn), "\n") <= 20)
+		test.Nil(o.New([]rune("pwd")))
+		test.Equal(strings.Count(readTestFile(fn), "pwd"), 0)
+	}
+}
+
+func TestHistoryIncAppend(t *testing.T) {
+	defer test.New(t)
+	cfg := &Config{HistoryIncAppend: true, HistoryLimit: 3, HistoryFlushCount: 10}
+	a, fn := newTestHistoryFile(t, cfg, "ls\nls\npwd\nmake\n")
+	defer a.Close()
+	// the file isn't trimmed nor deduplicated
+	test.Equal(historyLines(a), []string{"ls", "pwd", "make"})
+	test.Equal(readTestFile(fn), "ls\nls\npwd\nmake\n")
+
+	b := newOpHistory(&Config{HistoryFile: fn, HistoryIncAppend: true, HistoryLimit: 3})
+	test.Nil(b.Init())
+	defer b.Close()
+	test.Nil(a.New([]rune("a1")))
+	test.Nil(b.New([]rune("b1")))
+	test.Equal(readTestFile(fn), "ls\nls\npwd\nmake\na1\nb1\n")
+	// they're not seen until merged
+	test.Equal(historyLines(a), []string{"pwd", "make", "a1"})
+
+	test.Nil(a.Reload())
+	test.Equal(historyLines(a), []string{"make", "a1", "b1"})
+	test.Nil(b.New([]rune("b2")))
+	test.Nil(a.New([]rune("a2")))
+	// the others' commands follow ours, each one only once
+	test.Nil(b.Reload())
+	test.Equal(historyLines(b), []string{"b2", "a1", "a2"})
+	test.Nil(a.Reload())
+	test.Equal(historyLines(a), []string{"b1", "a2", "b2"})
+	test.Equal(readTestFile(fn), "ls\nls\npwd\nmake\na1\nb1\nb2\na2\n")
+}
+
+func TestHistoryInitN(t *testing.T) {
+	defer test.New(t)
+	fn := filepath.Join(t.TempDir(), "history")
+	test.Nil(ioutil.WriteFile(fn, []byte("ls\nls\npwd\nmake\ngit status\n"), 0666))
+	o := newOpHistory(&Config{HistoryFile: fn, HistoryLimit: 3})
+	defer o.Close()
+	n, err := o.InitN()
+	test.Nil(err)
+	test.Equal(n, 3)
+	reached := 0
+	for o.Prev() != nil {
+		reached++
+	}
+	test.Equal(reached, n)
+
+	// nothing is loaded again
+	n, err = o.InitN()
+	test.Nil(err)
+	test.Equal(n, 3)
+	n, err = newOpHistory(&Config{}).InitN()
+	test.Nil(err)
+	test.Equal(n, 0)
+
+	// the editing line isn't counted
+	test.Nil(o.Update([]rune("ec"), false))
+	test.Nil(o.New([]rune("ls")))
+	test.Equal(o.Len(), 3)
+	test.Nil(o.New([]rune("whoami")))
+	test.Equal(o.Len(), 3)
+	test.Equal(newTestHistory(&Config{}).Len(), 0)
+}
+
+func TestHistoryCommentPrefix(t *testing.T) {
+	defer test.New(t)
+	const content = "# history v2\n#1700000000\nls\n# note\npwd\nmake\n"
+	cfg := &Config{HistoryCommentPrefix: "#", HistoryTimestamp: true, HistoryLimit: 2}
+	o, fn := newTestHistoryFile(t, cfg, content)
+	test.Equal(historyLines(o), []string{"pwd", "make"})
+	test.Equal(readTestFile(fn), "# history v2\npwd\nmake\n")
+	o.Close()
+
+	// it's stable over the round trips
+	for i := 0; i < 2; i++ {
+		o = newOpHistory(cfg)
+		test.Nil(o.Init())
+		test.Nil(o.New([]rune(fmt.Sprintf("echo %d", i))))
+		o.Rewrite()
+		o.Close()
+	}
+	test.True(strings.HasPrefix(readTestFile(fn), "# history v2\n#"))
+	test.Equal(strings.Count(readTestFile(fn), "# history v2"), 1)
+	o = newOpHistory(cfg)
+	test.Nil(o.Init())
+	test.Equal(historyLines(o), []string{"echo 0", "echo 1"})
+	o.Close()
+
+	o, _ = newTestHistoryFile(t, &Config{}, content)
+	defer o.Close()
+	test.Equal(historyLines(o), []string{"# history v2", "#1700000000", "ls", "# note", "pwd", "make"})
+}
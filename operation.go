@@ -1,6 +1,7 @@
 package readline
 
 import (
+	"context"
 	"errors"
 	"io"
 	"sync"
@@ -25,7 +26,9 @@ type Operation struct {
 	buf     *RuneBuffer
 	outchan chan []rune
 	errchan chan error
-	w       io.Writer
+	// cancelchan is sent by RunesContext to make ioloop drop the current line
+	cancelchan chan struct{}
+	w          io.Writer
 
 	history *opHistory
 	*opSearch
@@ -67,15 +70,24 @@ func (w *wrapWriter) Write(b []byte) (int, error) {
 }
 
 func NewOperation(t *Terminal, cfg *Config) *Operation {
+	op, _ := newOperation(t, cfg)
+	return op
+}
+
+// newOperation is NewOperation reporting the error of SetConfig, e.g. HistoryFile
+// is failed to load
+func newOperation(t *Terminal, cfg *Config) (*Operation, error) {
 	width := cfg.FuncGetWidth()
 	op := &Operation{
 		t:       t,
 		buf:     NewRuneBuffer(t, cfg.Prompt, cfg, width),
 		outchan: make(chan []rune),
 		errchan: make(chan error, 1),
+
+		cancelchan: make(chan struct{}),
 	}
 	op.w = op.buf.w
-	op.SetConfig(cfg)
+	_, err := op.SetConfig(cfg)
 	op.opVim = newVimMode(op)
 	op.opCompleter = newOpCompleter(op.buf.w, op, width)
 	op.opPassword = newOpPassword(op)
@@ -86,7 +98,7 @@ func NewOperation(t *Terminal, cfg *Config) *Operation {
 		op.buf.OnWidthChange(newWidth)
 	})
 	go op.ioloop()
-	return op
+	return op, err
 }
 
 func (o *Operation) SetPrompt(s string) {
@@ -108,7 +120,11 @@ func (o *Operation) ioloop() {
 	for {
 		keepInSearchMode := false
 		keepInCompleteMode := false
-		r := o.t.ReadRune()
+		r, ok := o.t.readRuneOr(o.cancelchan)
+		if !ok {
+			o.cancel()
+			continue
+		}
 
 		if o.GetConfig().FuncFilterInputRune != nil {
 			var process bool
@@ -253,7 +269,13 @@ func (o *Operation) ioloop() {
 				o.buf.Clean()
 				data = o.buf.Reset()
 			}
-			o.outchan <- data
+			select {
+			case o.outchan <- data:
+			case <-o.cancelchan:
+				// RunesContext is gone, don't leave the line to the next call
+				o.cancel()
+				continue
+			}
 			if !o.GetConfig().DisableAutoSaveHistory {
 				// ignore IO error
 				_ = o.history.New(data)
@@ -379,6 +401,12 @@ func (o *Operation) String() (string, error) {
 }
 
 func (o *Operation) Runes() ([]rune, error) {
+	return o.RunesContext(context.Background())
+}
+
+// RunesContext is like Runes, but it returns ctx.Err() once ctx is done.
+// The partial line is dropped without being saved to history.
+func (o *Operation) RunesContext(ctx context.Context) ([]rune, error) {
 	o.t.EnterRawMode()
 	defer o.t.ExitRawMode()
 
@@ -397,7 +425,27 @@ func (o *Operation) Runes() ([]rune, error) {
 			return e.Line, ErrInterrupt
 		}
 		return nil, err
+	case <-ctx.Done():
+		// let ioloop drop the line, an error which is sent meanwhile belongs
+		// to the cancelled line too
+		select {
+		case o.cancelchan <- struct{}{}:
+		case <-o.errchan:
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// cancel drops the current line for RunesContext, it's called by ioloop
+func (o *Operation) cancel() {
+	if o.IsSearchMode() {
+		o.ExitSearchMode(true)
+	}
+	if o.IsInCompleteMode() {
+		o.ExitCompleteMode(true)
 	}
+	o.buf.Refresh(func() { o.buf.Reset() })
+	o.history.Revert()
 }
 
 func (o *Operation) PasswordEx(prompt string, l Listener) ([]byte, error) {
@@ -440,17 +488,44 @@ func (o *Operation) Close() {
 	case o.errchan <- io.EOF:
 	default:
 	}
-	o.history.Close()
+	o.history.CloseSession()
 }
 
 func (o *Operation) SetHistoryPath(path string) {
 	if o.history != nil {
 		o.history.Close()
 	}
+	if !o.cfg.HistoryNoExpand {
+		path = expandHistoryPath(path)
+	}
 	o.cfg.HistoryFile = path
 	o.history = newOpHistory(o.cfg)
 }
 
+// RelocateHistory moves HistoryFile to path, which is expanded like SetHistoryPath,
+// and keeps saving the commands to it
+func (o *Operation) RelocateHistory(path string) error {
+	if !o.cfg.HistoryNoExpand {
+		path = expandHistoryPath(path)
+	}
+	return o.history.Relocate(path)
+}
+
+// MergeHistory pulls in the commands appended to HistoryFile by others
+func (o *Operation) MergeHistory() error {
+	return o.history.Reload()
+}
+
+// CompactHistory trims history to HistoryLimit
+func (o *Operation) CompactHistory() {
+	o.history.Trim()
+}
+
+// CompactHistoryFile trims history and rewrites HistoryFile with it
+func (o *Operation) CompactHistoryFile() error {
+	return o.history.CompactFile()
+}
+
 func (o *Operation) IsNormalMode() bool {
 	return !o.IsInCompleteMode() && !o.IsSearchMode()
 }
@@ -480,20 +555,121 @@ func (op *Operation) SetConfig(cfg *Config) (*Config, error) {
 
 	// SetHistoryPath will close opHistory which already exists
 	// so if we use it next time, we need to reopen it by `InitHistory()`
-	op.history.Init()
+	err := op.history.Init()
 
 	if op.cfg.AutoComplete != nil {
 		op.opCompleter = newOpCompleter(op.buf.w, op, width)
 	}
 
 	op.opSearch = cfg.opSearch
-	return old, nil
+	return old, err
+}
+
+// CloseHistory stops saving commands to the history file until OpenHistory is called,
+// the commands are still kept in memory.
+func (o *Operation) CloseHistory() {
+	o.history.Close()
+}
+
+// FlushHistory saves the pending commands into the history file and syncs it to the disk
+func (o *Operation) FlushHistory() error {
+	return o.history.Flush()
+}
+
+// OpenHistory resumes saving commands to the history file after CloseHistory
+func (o *Operation) OpenHistory() error {
+	return o.history.Init()
 }
 
 func (o *Operation) ResetHistory() {
 	o.history.Reset()
 }
 
+// ClearHistory removes all the commands in history, including the ones in history file.
+func (o *Operation) ClearHistory() error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return o.history.Clear()
+}
+
+// ExportHistory writes all the commands in history to w
+func (o *Operation) ExportHistory(w io.Writer, format HistoryFormat) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return o.history.Export(w, format)
+}
+
+// DumpHistory writes the commands in history to w one per line, numbered if withNumbers
+func (o *Operation) DumpHistory(w io.Writer, withNumbers bool) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return o.history.Dump(w, withNumbers)
+}
+
+// ImportHistory reads the commands written by ExportHistory and saves them into history
+func (o *Operation) ImportHistory(r io.Reader, format HistoryFormat) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return o.history.Import(r, format)
+}
+
+// History returns a copy of all the commands in history, from the oldest to the newest
+func (o *Operation) History() [][]rune {
+	return o.history.History()
+}
+
+// WalkHistory calls fn with each command in history until it returns false,
+// from the newest to the oldest if newestFirst is set
+func (o *Operation) WalkHistory(newestFirst bool, fn func(line []rune) bool) {
+	o.history.Walk(newestFirst, fn)
+}
+
+// HistoryEntries returns a copy of all the commands in history with their metadata,
+// from the oldest to the newest
+func (o *Operation) HistoryEntries() []HistoryEntry {
+	return o.history.Entries()
+}
+
+// HistoryLen returns how many commands are in history
+func (o *Operation) HistoryLen() int {
+	return o.history.Len()
+}
+
+// HistoryByNumber returns the command numbered n in history
+func (o *Operation) HistoryByNumber(n int) ([]rune, bool) {
+	return o.history.ByNumber(n)
+}
+
+// HistoryStats counts the commands in history, with up to top most frequent ones,
+// all of them if top <= 0
+func (o *Operation) HistoryStats(top int) HistoryStats {
+	return o.history.Stats(top)
+}
+
+// SearchHistory returns up to limit commands matching query by the searching options
+// in Config, the newest first. It doesn't change the interactive searching.
+func (o *Operation) SearchHistory(query []rune, limit int) []SearchResult {
+	return o.history.Search(query, limit)
+}
+
+// SuggestHistory returns the most frequent and recent command starting with prefix,
+// or nil if there isn't one
+func (o *Operation) SuggestHistory(prefix []rune) []rune {
+	return o.history.Suggest(prefix)
+}
+
+// LoadHistory reads the commands in the format of HistoryFile from r, and adds
+// them to history without writing HistoryFile
+func (o *Operation) LoadHistory(r io.Reader) error {
+	return o.history.Load(r)
+}
+
+// AddHistory saves content as a command run before the editing line, which
+// is kept untouched unlike SaveHistory. err is only for writing to file.
+func (o *Operation) AddHistory(content string) error {
+	return o.history.Add([]rune(content))
+}
+
 // if err is not nil, it just mean it fail to write to file
 // other things goes fine.
 func (o *Operation) SaveHistory(content string) error {
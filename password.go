@@ -16,6 +16,10 @@ func (o *opPassword) ExitPasswordMode() {
 
 func (o *opPassword) EnterPasswordMode(cfg *Config) (err error) {
 	o.backupCfg, err = o.o.SetConfig(cfg)
+	if err != nil {
+		// cfg may be set with its history failed
+		o.ExitPasswordMode()
+	}
 	return
 }
 
@@ -18,7 +18,11 @@
 package readline
 
 import (
+	"context"
+	"crypto/cipher"
 	"io"
+	"os"
+	"time"
 )
 
 type Instance struct {
@@ -31,13 +35,212 @@ type Config struct {
 	// prompt supports ANSI escape sequence, so we can color some characters even in windows
 	Prompt string
 
-	// readline will persist historys to file where HistoryFile specified
+	// readline will persist historys to file where HistoryFile specified.
+	// it's kept in memory only if it's empty, e.g. for the tests or an
+	// ephemeral REPL, and the oldest ones are dropped by HistoryLimit.
 	HistoryFile string
+	// HistoryFile is expanded like a shell does, e.g. ~/.history or $HOME/.history,
+	// set it to use the path as is
+	HistoryNoExpand bool
 	// specify the max length of historys, it's 500 by default, set it to -1 to disable history
-	HistoryLimit           int
+	HistoryLimit int
+	// keep all the commands in memory and in HistoryFile, HistoryLimit is ignored.
+	// HistoryFileLimit still trims the file if it's set.
+	HistoryNoLimit         bool
 	DisableAutoSaveHistory bool
-	// enable case-insensitive history searching
+	// HistoryFile is rewritten on loading if it has more than HistoryFileLimit commands,
+	// or some of them are dropped by deduplicating. set it to leave the file untouched,
+	// e.g. when it's shared with a shell of a larger limit. only the last HistoryLimit
+	// commands are still loaded.
+	HistoryKeepFileOnLoad bool
+	// the lines of HistoryFile beginning with it are comments rather than
+	// commands, e.g. "#" for a format-version header. the ones before the first
+	// command are written back by rewriting the file, the others are dropped.
+	// the timestamps of HistoryTimestamp are still parsed as usual.
+	HistoryCommentPrefix string
+	// share HistoryFile with the other sessions like inc_append_history of zsh.
+	// each command is appended at once regardless of HistoryFlushCount, the file
+	// is left untouched on loading like HistoryKeepFileOnLoad, and the commands
+	// of the others are only pulled in by MergeHistory. it doesn't work with
+	// HistoryCompress, which rewrites the whole file.
+	HistoryIncAppend bool
+	// the most commands kept in HistoryFile, like HISTFILESIZE. it falls back to
+	// HistoryLimit if it's 0. a larger one keeps the commands evicted from memory
+	// when HistoryFile is rewritten, a smaller one trims them from the file only.
+	HistoryFileLimit int
+	// what to do with HistoryFile when it's loaded with more commands than
+	// HistoryFileLimit, e.g. after lowering it. ShrinkRewrite by default, which
+	// loses the older commands for good.
+	HistoryShrinkPolicy ShrinkPolicy
+	// reload HistoryFile on closing the instance, and rewrite it deduplicated and
+	// trimmed to HistoryFileLimit, including the commands appended by other processes.
+	// it's done once at the end of the session, not by CloseHistory. it's done under
+	// the lock of HistoryFileLock if it's set.
+	HistoryCompactOnClose bool
+	// start with history disabled, HistoryFile isn't even opened until
+	// HistoryEnable is called. nothing is recorded then, unlike an empty
+	// HistoryFile which keeps history in memory only.
+	DisableHistory bool
+	// enable case-insensitive history searching, it's also the default of
+	// HistoryDedupFold, HistoryIgnoreFold and HistoryPrefixFold
 	HistorySearchFold bool
+	// treat the searching keyword as a regular expression,
+	// it falls back to the literal searching if it's not a valid one
+	HistorySearchRegex bool
+	// normalize the item and the keyword to NFC when searching, so `cafe\u0301`
+	// is found by `caf\u00e9`.
+	HistorySearchNormalize bool
+	// only match the searching keyword as a whole word, so "port" isn't
+	// found in "transport". the words are split as the word motions do.
+	HistorySearchWholeWord bool
+	// match the searching keyword fuzzily, e.g. "gco" matches "git checkout origin",
+	// the entry with the fewest gaps is preferred. it takes precedence over HistorySearchRegex
+	HistorySearchFuzzy bool
+	// only search the commands entered in this session, leaving out the ones
+	// loaded from HistoryFile. they're still reachable by Prev/Next.
+	HistorySearchSessionOnly bool
+	// search the line being edited as well, before the commands in history
+	HistorySearchIncludeCurrent bool
+	// Prev/Next only walk through the commands starting with the editing line,
+	// like history-search-backward in bash
+	HistorySearchPrefix bool
+	// the case policy of HistorySearchPrefix and PrevPrefix/NextPrefix,
+	// it follows HistorySearchFold by default
+	HistoryPrefixFold CaseFold
+	// merge the commands appended to HistoryFile by other processes
+	// before searching history
+	HistoryReloadOnSearch bool
+	// Prev wraps to the newest command at the oldest one, and Next wraps to
+	// the oldest one at the editing line
+	HistoryWrap bool
+	// reorders the commands reached by Prev/Next, it's given the commands from the
+	// oldest to the newest and returns their indexes in the new order, so Prev
+	// starts from the last one. it's called again once history is changed, and
+	// the editing line is always after them all. an invalid permutation is ignored.
+	HistoryOrderFunc func(entries [][]rune) []int
+	// Prev/Next skip the blank entries, e.g. loaded by HistoryNoTrim or imported,
+	// set it to stop at them as well
+	HistoryKeepBlank bool
+	// only report the commands which would be removed by HistoryLimit or
+	// deduplicating as HistoryEvents with DryRun set, they're kept in history,
+	// and HistoryFile isn't rewritten on loading nor by HistoryCompactOnClose
+	HistoryDryRun bool
+	// how duplicated commands are collapsed, DedupConsecutive by default
+	HistoryDedup DedupMode
+	// the case policy when deduplicating history, it follows HistorySearchFold by default
+	HistoryDedupFold CaseFold
+	// reports whether two commands are the same when deduplicating, e.g. to ignore
+	// the trailing spaces. it takes precedence over HistoryDedupFold
+	HistorySameLineFunc func(a, b []rune) bool
+	// commands matching any of these glob patterns will not be saved, like HISTIGNORE.
+	// the '*' matches any characters including '/'
+	HistoryIgnore []string
+	// the case policy when matching HistoryIgnore, it follows HistorySearchFold by default
+	HistoryIgnoreFold CaseFold
+	// commands beginning with a space or tab will not be saved, like HISTCONTROL=ignorespace
+	HistoryIgnoreSpace bool
+	// write a unix timestamp comment like `#1700000000` before each command
+	// in HistoryFile, which follows the bash convention
+	HistoryTimestamp bool
+	// write the working directory of each command as a comment like `#dir /home`
+	// before it in HistoryFile, see HistoryEntries. it's got from FuncGetDir
+	// when the command is committed, or os.Getwd by default.
+	HistoryRecordDir bool
+	FuncGetDir       func() string
+	// write the time and directory of the commands as JSON lines to HistoryFile
+	// with the ".meta" suffix instead of the comment lines, so HistoryFile is
+	// left plain for bash and fzf. the time of each command is always recorded
+	// then. if they're out of sync, e.g. HistoryFile is written by others, the
+	// commands are loaded without the metadata from there on.
+	HistorySidecar bool
+	// skip the lines loaded from HistoryFile which have a NUL or mostly unprintable
+	// characters, e.g. left by a crash. HistoryFile is rewritten without them.
+	HistorySkipGarbage bool
+	// the line ending written to HistoryFile, "\n" by default or "\r\n",
+	// both of them are accepted when loading. "\x00" delimits the commands by NUL
+	// like `find -print0`, so a multi-line command is saved as is.
+	HistoryLineEnding string
+	// keep the leading and trailing spaces of the commands loaded from HistoryFile,
+	// only the line ending is stripped. they're trimmed by default.
+	HistoryNoTrim bool
+	// save a multi-line command as one entry, by escaping the newline as `\n`
+	// and the backslash as `\\` in HistoryFile. otherwise the newline is saved
+	// as a space. the escaped file begins with a "#readline:multiline" line, only
+	// such a file is unescaped. the one without it is rewritten escaped on
+	// loading, or kept unescaped if it's left untouched, e.g. by HistoryKeepFileOnLoad.
+	HistoryMultiline bool
+	// encrypt each command in HistoryFile, stored as the base64 of nonce||ciphertext.
+	// the file isn't loaded nor written if any line can't be decrypted by it.
+	HistoryCipher cipher.AEAD
+	// the max length of a history entry, counted in runes rather than bytes,
+	// so a multi-byte UTF-8 character is counted as one. 0 means no limit.
+	// the oversized entry will be dropped unless HistoryTruncateOversize is set
+	HistoryMaxEntryBytes int
+	// truncate the oversized entry and append an ellipsis instead of dropping it
+	HistoryTruncateOversize bool
+	// rename HistoryFile with the ".1" suffix and start a new one once it's
+	// larger than HistoryMaxBytes, 0 means no limit. it's independent of HistoryLimit.
+	HistoryMaxBytes int64
+	// how many files rotated by HistoryMaxBytes are kept, 1 by default. the older
+	// ones are shifted to ".2", ".3" and so on, the oldest beyond it is removed.
+	HistoryRotateCount int
+	// load the files rotated by HistoryMaxBytes before HistoryFile, the oldest first.
+	// the ".1" one is loaded without it, so the recent commands survive a rotation.
+	HistoryLoadRotated bool
+	// the files loaded before HistoryFile in order, e.g. a global history
+	// beneath a per-directory HistoryFile. new commands are only saved into
+	// HistoryFile, and these files are never written.
+	HistoryExtraFiles []string
+	// transform the committed command before it's written to HistoryFile,
+	// e.g. to redact the secrets. the command is dropped if it returns empty.
+	// the command in memory is only changed with HistorySanitizeMemory.
+	HistorySanitize       func([]rune) []rune
+	HistorySanitizeMemory bool
+	// keep the history in memory if HistoryFile can't be opened,
+	// otherwise the error is returned by NewEx.
+	HistoryFallbackMemory bool
+	// check HistoryFile before saving each command, and reopen it if it's removed
+	// or replaced by others, e.g. logrotate, instead of writing to the unlinked one.
+	HistoryReopenOnMissing bool
+	// load HistoryFile but never write it, the committed commands are only kept
+	// in memory. it's neither created nor locked, and ClearHistory returns
+	// ErrHistoryReadOnly after clearing the memory.
+	HistoryReadOnly bool
+	// the permission of HistoryFile when it's created or rewritten, e.g. 0600 to keep
+	// it private. it's 0666 before umask by default.
+	HistoryFileMode os.FileMode
+	// fsync the HistoryFile after each command is saved
+	HistorySync bool
+	// take an advisory lock on `HistoryFile + ".lock"` when loading or saving,
+	// so several processes can share one HistoryFile.
+	HistoryFileLock bool
+	// store HistoryFile with gzip, it's also enabled if HistoryFile ends with ".gz".
+	// since the whole file is rewritten for saving commands, it's done at most
+	// once per HistoryCompressInterval, and the pending commands is saved on Close.
+	HistoryCompress         bool
+	HistoryCompressInterval time.Duration
+	// load the commands before the part HistoryFile is broken at, e.g. a
+	// compressed one cut by a crash, instead of none of them. it's rewritten with
+	// those then, and ErrHistoryTruncated is returned by loading it, e.g. by
+	// NewEx along with the working Instance.
+	HistoryBestEffort bool
+	// buffer the commands and write them to HistoryFile once HistoryFlushCount
+	// commands are pending, or HistoryFlushInterval passed since the last one.
+	// the pending commands are written on Close, they're lost if the process crashes.
+	// Prev/Next and searching are served from memory, which has them at once,
+	// HistoryFile only catches up on the flushing. with HistoryFlushInterval only,
+	// the flushing is done off the readline loop, e.g. for a HistoryFile on a slow
+	// network filesystem.
+	HistoryFlushInterval time.Duration
+	HistoryFlushCount    int
+	// called with a copy of the command once it's saved into history,
+	// see NewHistoryAuditor for writing them to syslog. it's called by the
+	// readline loop, so hand a slow store, e.g. a remote one, to a goroutine.
+	OnHistoryCommit func(line []rune)
+	// receives the changes of history, e.g. for a live view of it, and the problems
+	// not failing it by HistoryWarning. the events are dropped rather than blocking
+	// if it's full, so give it a buffer.
+	HistoryEvents chan<- HistoryEvent
 
 	// AutoCompleter will called once user press TAB
 	AutoComplete AutoCompleter
@@ -161,20 +364,30 @@ func (c *Config) SetPainter(p Painter) {
 	c.Painter = p
 }
 
+// NewEx creates an Instance by cfg, the Instance is returned along with
+// ErrHistoryTruncated since it works as usual then.
 func NewEx(cfg *Config) (*Instance, error) {
 	t, err := NewTerminal(cfg)
 	if err != nil {
 		return nil, err
 	}
-	rl := t.Readline()
+	// the HistoryFile is opened by SetConfig, report it if it's failed
+	rl, err := newOperation(t, t.cfg)
 	if cfg.Painter == nil {
 		cfg.Painter = &defaultPainter{}
 	}
-	return &Instance{
+	i := &Instance{
 		Config:    cfg,
 		Terminal:  t,
 		Operation: rl,
-	}, nil
+	}
+	if err == ErrHistoryTruncated {
+		return i, err
+	} else if err != nil {
+		i.Close()
+		return nil, err
+	}
+	return i, nil
 }
 
 func New(prompt string) (*Instance, error) {
@@ -185,6 +398,89 @@ func (i *Instance) ResetHistory() {
 	i.Operation.ResetHistory()
 }
 
+// CloseHistory stops saving commands to the history file until OpenHistory is called,
+// the commands are still kept in memory.
+func (i *Instance) CloseHistory() {
+	i.Operation.CloseHistory()
+}
+
+// FlushHistory saves the pending commands into the history file and syncs it to the disk
+func (i *Instance) FlushHistory() error {
+	return i.Operation.FlushHistory()
+}
+
+// OpenHistory resumes saving commands to the history file after CloseHistory
+func (i *Instance) OpenHistory() error {
+	return i.Operation.OpenHistory()
+}
+
+// ClearHistory removes all the commands in history, including the ones in history file.
+func (i *Instance) ClearHistory() error {
+	return i.Operation.ClearHistory()
+}
+
+// ExportHistory writes all the commands in history to w
+func (i *Instance) ExportHistory(w io.Writer, format HistoryFormat) error {
+	return i.Operation.ExportHistory(w, format)
+}
+
+// DumpHistory writes the commands in history to w one per line, numbered if withNumbers
+func (i *Instance) DumpHistory(w io.Writer, withNumbers bool) error {
+	return i.Operation.DumpHistory(w, withNumbers)
+}
+
+// ImportHistory reads the commands written by ExportHistory and saves them into history
+func (i *Instance) ImportHistory(r io.Reader, format HistoryFormat) error {
+	return i.Operation.ImportHistory(r, format)
+}
+
+// History returns a copy of all the commands in history, from the oldest to the newest
+func (i *Instance) History() [][]rune {
+	return i.Operation.History()
+}
+
+// WalkHistory calls fn with each command in history until it returns false,
+// from the newest to the oldest if newestFirst is set. fn mustn't change history.
+func (i *Instance) WalkHistory(newestFirst bool, fn func(line []rune) bool) {
+	i.Operation.WalkHistory(newestFirst, fn)
+}
+
+// HistoryEntries returns a copy of all the commands in history with their metadata,
+// from the oldest to the newest
+func (i *Instance) HistoryEntries() []HistoryEntry {
+	return i.Operation.HistoryEntries()
+}
+
+// HistoryLen returns how many commands are in history, e.g. for a UI to show it
+// without copying them
+func (i *Instance) HistoryLen() int {
+	return i.Operation.HistoryLen()
+}
+
+// HistoryByNumber returns the command numbered n, like !n of csh. the numbers
+// don't change when the older commands are evicted by HistoryLimit.
+func (i *Instance) HistoryByNumber(n int) ([]rune, bool) {
+	return i.Operation.HistoryByNumber(n)
+}
+
+// HistoryStats counts the commands in history, with up to top most frequent ones,
+// all of them if top <= 0
+func (i *Instance) HistoryStats(top int) HistoryStats {
+	return i.Operation.HistoryStats(top)
+}
+
+// SearchHistory returns up to limit commands matching query by the searching options
+// in Config, the newest first. It doesn't change the interactive searching.
+func (i *Instance) SearchHistory(query []rune, limit int) []SearchResult {
+	return i.Operation.SearchHistory(query, limit)
+}
+
+// SuggestHistory returns the most frequent and recent command starting with prefix,
+// or nil if there isn't one
+func (i *Instance) SuggestHistory(prefix []rune) []rune {
+	return i.Operation.SuggestHistory(prefix)
+}
+
 func (i *Instance) SetPrompt(s string) {
 	i.Operation.SetPrompt(s)
 }
@@ -198,6 +494,30 @@ func (i *Instance) SetHistoryPath(p string) {
 	i.Operation.SetHistoryPath(p)
 }
 
+// RelocateHistory moves HistoryFile to path without losing the commands in it,
+// unlike SetHistoryPath which starts over with the file at path
+func (i *Instance) RelocateHistory(path string) error {
+	return i.Operation.RelocateHistory(path)
+}
+
+// MergeHistory pulls in the commands appended to HistoryFile by the other
+// sessions since it's read last time, see HistoryIncAppend
+func (i *Instance) MergeHistory() error {
+	return i.Operation.MergeHistory()
+}
+
+// CompactHistory trims history to HistoryLimit, e.g. after a command is done
+func (i *Instance) CompactHistory() {
+	i.Operation.CompactHistory()
+}
+
+// CompactHistoryFile rewrites HistoryFile deduplicated and trimmed to
+// HistoryFileLimit now, instead of waiting for the next rewriting. it does
+// nothing if there's no HistoryFile to write.
+func (i *Instance) CompactHistoryFile() error {
+	return i.Operation.CompactHistoryFile()
+}
+
 // readline will refresh automatic when write through Stdout()
 func (i *Instance) Stdout() io.Writer {
 	return i.Operation.Stdout()
@@ -257,6 +577,14 @@ func (i *Instance) Readline() (string, error) {
 	return i.Operation.String()
 }
 
+// ReadlineWithContext is like Readline, but it returns ctx.Err() once ctx is done,
+// e.g. when the client of a remote REPL is gone. The partial line isn't saved
+// to history.
+func (i *Instance) ReadlineWithContext(ctx context.Context) (string, error) {
+	r, err := i.Operation.RunesContext(ctx)
+	return string(r), err
+}
+
 func (i *Instance) ReadlineWithDefault(what string) (string, error) {
 	i.Operation.SetBuffer(what)
 	return i.Operation.String()
@@ -266,6 +594,18 @@ func (i *Instance) SaveHistory(content string) error {
 	return i.Operation.SaveHistory(content)
 }
 
+// LoadHistory reads the commands in the format of HistoryFile from r, e.g. embedded
+// in the program, and adds them to history without writing HistoryFile
+func (i *Instance) LoadHistory(r io.Reader) error {
+	return i.Operation.LoadHistory(r)
+}
+
+// AddHistory saves content as a command run before the editing line, which
+// is kept untouched unlike SaveHistory
+func (i *Instance) AddHistory(content string) error {
+	return i.Operation.AddHistory(content)
+}
+
 // same as readline
 func (i *Instance) ReadSlice() ([]byte, error) {
 	return i.Operation.Slice()
@@ -336,3 +676,11 @@ func (i *Instance) HistoryDisable() {
 func (i *Instance) HistoryEnable() {
 	i.Operation.history.Enable()
 }
+
+// SetHistoryEnabled enables or disables the save of the commands into the history,
+// it returns the previous state, e.g.
+//	prev := rl.SetHistoryEnabled(false)
+//	defer rl.SetHistoryEnabled(prev)
+func (i *Instance) SetHistoryEnabled(enable bool) (prev bool) {
+	return i.Operation.history.SetEnabled(enable)
+}
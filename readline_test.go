@@ -1,6 +1,15 @@
 package readline
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -25,3 +34,183 @@ func TestRace(t *testing.T) {
 
 	rl.Readline()
 }
+
+func TestReadlineWithContext(t *testing.T) {
+	pr, pw := io.Pipe()
+	rl, err := NewEx(&Config{Stdin: pr, Stdout: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	// let Close stop the terminal reading it
+	defer pw.Close()
+	rl.SaveHistory("ls")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		pw.Write([]byte("partial"))
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := rl.ReadlineWithContext(ctx); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	if n := len(rl.Operation.history.History()); n != 1 {
+		t.Fatal("history is changed by the cancelled line, got", n)
+	}
+
+	go pw.Write([]byte("pwd\n"))
+	line, err := rl.Readline()
+	if err != nil || line != "pwd" {
+		t.Fatal("the partial line is left in the buffer, got", line, err)
+	}
+}
+
+func TestReadlineWithContextEntered(t *testing.T) {
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	rl, err := NewEx(&Config{
+		Stdin:  pr,
+		Stdout: ioutil.Discard,
+		// cancel it right before the Enter is handled
+		FuncFilterInputRune: func(r rune) (rune, bool) {
+			if r == CharCtrlJ && ctx.Err() == nil {
+				cancel()
+				time.Sleep(50 * time.Millisecond)
+			}
+			return r, true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	defer pw.Close()
+
+	go pw.Write([]byte("stale\n"))
+	if _, err := rl.ReadlineWithContext(ctx); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	if n := len(rl.Operation.history.History()); n != 0 {
+		t.Fatal("the cancelled line is saved to history, got", n)
+	}
+
+	go pw.Write([]byte("pwd\n"))
+	line, err := rl.Readline()
+	if err != nil || line != "pwd" {
+		t.Fatal("the cancelled line is returned by the next call, got", line, err)
+	}
+}
+
+func TestNewExHistoryError(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	fn := filepath.Join(t.TempDir(), "missing", "history")
+	rl, err := NewEx(&Config{Stdin: pr, Stdout: ioutil.Discard, HistoryFile: fn})
+	if !errors.Is(err, ErrHistoryLoad) || rl != nil {
+		t.Fatal("expected ErrHistoryLoad, got", rl, err)
+	}
+}
+
+func TestNewExHistoryTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(gz, "echo %d\n", i)
+	}
+	gz.Close()
+	fn := filepath.Join(t.TempDir(), "history.gz")
+	if err := ioutil.WriteFile(fn, buf.Bytes()[:buf.Len()/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	rl, err := NewEx(&Config{Stdin: pr, Stdout: ioutil.Discard, HistoryFile: fn, HistoryBestEffort: true})
+	if err != ErrHistoryTruncated || rl == nil {
+		t.Fatal("expected ErrHistoryTruncated with the instance, got", rl, err)
+	}
+	defer rl.Close()
+	if len(rl.Operation.history.History()) == 0 {
+		t.Fatal("the commands before the broken part aren't loaded")
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	rl, err := NewEx(&Config{Stdin: pr, Stdout: ioutil.Discard, HistoryLimit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	for _, line := range []string{"ls", "pwd", "make"} {
+		if err := rl.SaveHistory(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var lines []string
+	for _, line := range rl.History() {
+		lines = append(lines, string(line))
+	}
+	if !reflect.DeepEqual(lines, []string{"pwd", "make"}) {
+		t.Fatal("the oldest isn't dropped by HistoryLimit, got", lines)
+	}
+}
+
+func TestHistoryNoLimitConfig(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&buf, "echo %d\n", i)
+	}
+	fn := filepath.Join(t.TempDir(), "history")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	cfg := &Config{Stdin: pr, Stdout: ioutil.Discard, HistoryFile: fn, HistoryNoLimit: true}
+	rl, err := NewEx(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	if err := rl.SaveHistory("ls"); err != nil {
+		t.Fatal(err)
+	}
+	if n := rl.HistoryLen(); n != 1001 {
+		t.Fatal("history is limited, got", n)
+	}
+	if data, _ := ioutil.ReadFile(fn); string(data) != buf.String()+"ls\n" {
+		t.Fatal("history file is rewritten")
+	}
+}
+
+func TestHistoryCompactOnCloseOnce(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "history")
+	if err := ioutil.WriteFile(fn, []byte("a\na\nb\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	rl, err := NewEx(&Config{
+		Stdin: pr, Stdout: ioutil.Discard, HistoryFile: fn,
+		HistoryKeepFileOnLoad: true, HistoryCompactOnClose: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// closing the history midway, or switching it like the password mode does
+	rl.CloseHistory()
+	if err := rl.OpenHistory(); err != nil {
+		t.Fatal(err)
+	}
+	rl.SetConfig(rl.SetConfig(rl.GenPasswordConfig()))
+	if data, _ := ioutil.ReadFile(fn); string(data) != "a\na\nb\n" {
+		t.Fatal("history file is compacted before the end, got", string(data))
+	}
+	rl.Close()
+	if data, _ := ioutil.ReadFile(fn); string(data) != "a\nb\n" {
+		t.Fatal("history file isn't compacted by Close, got", string(data))
+	}
+}
@@ -571,6 +571,27 @@ func (r *RuneBuffer) SetStyle(start, end int, style string) {
 	// TODO: move back
 }
 
+// SetStyles is SetStyle for each of the spans, which are in order and don't
+// overlap, the cursor is left at the end of the last one
+func (r *RuneBuffer) SetStyles(spans [][2]int, style string) {
+	pos := r.idx
+	for _, span := range spans {
+		start, end := span[0], span[1]
+		if end < start {
+			panic("end < start")
+		}
+		if start > pos {
+			r.w.Write([]byte(string(r.buf[pos:start])))
+		} else {
+			r.w.Write(bytes.Repeat([]byte("\b"), runes.WidthAll(r.buf[start:pos])))
+		}
+		r.w.Write([]byte("\033[" + style + "m"))
+		r.w.Write([]byte(string(r.buf[start:end])))
+		r.w.Write([]byte("\033[0m"))
+		pos = end
+	}
+}
+
 func (r *RuneBuffer) SetWithIdx(idx int, buf []rune) {
 	r.Refresh(func() {
 		r.buf = buf
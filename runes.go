@@ -21,14 +21,30 @@ func (Runes) EqualRune(a, b rune, fold bool) bool {
 	if a > b {
 		a, b = b, a
 	}
-	if b < utf8.RuneSelf && 'A' <= a && a <= 'Z' {
-		if b == a+'a'-'A' {
+	if b < utf8.RuneSelf {
+		return 'A' <= a && a <= 'Z' && b == a+'a'-'A'
+	}
+	// the runes equal by the simple case folding, e.g. 'É' and 'é'
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
 			return true
 		}
 	}
 	return false
 }
 
+// FoldRune returns the smallest rune equal to r by EqualRuneFold, so the runes
+// equal by it are mapped to the same one
+func (Runes) FoldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
+
 func (r Runes) EqualRuneFold(a, b rune) bool {
 	return r.EqualRune(a, b, true)
 }
@@ -85,6 +101,18 @@ func (rs Runes) IndexAll(r, sub []rune) int {
 	return rs.IndexAllEx(r, sub, false)
 }
 
+// IndexAllFromEx is IndexAllEx which starts searching at from
+func (rs Runes) IndexAllFromEx(r, sub []rune, from int, fold bool) int {
+	if from > len(r) {
+		return -1
+	}
+	idx := rs.IndexAllEx(r[from:], sub, fold)
+	if idx < 0 {
+		return idx
+	}
+	return from + idx
+}
+
 func (rs Runes) IndexAllEx(r, sub []rune, fold bool) int {
 	for i := 0; i < len(r); i++ {
 		found := true
@@ -104,6 +132,24 @@ func (rs Runes) IndexAllEx(r, sub []rune, fold bool) int {
 	return -1
 }
 
+// IndexAllOccurrences returns the index of each occurrence of sub in r, from
+// left to right. the occurrences don't overlap, so "aa" is found once in "aaa".
+func (rs Runes) IndexAllOccurrences(r, sub []rune, fold bool) []int {
+	if len(sub) == 0 {
+		return nil
+	}
+	var ret []int
+	for i := 0; i < len(r); {
+		idx := rs.IndexAllEx(r[i:], sub, fold)
+		if idx < 0 {
+			break
+		}
+		ret = append(ret, i+idx)
+		i += idx + len(sub)
+	}
+	return ret
+}
+
 func (Runes) Index(r rune, rs []rune) int {
 	for i := 0; i < len(rs); i++ {
 		if rs[i] == r {
@@ -187,6 +233,36 @@ func (Runes) HasPrefix(r, prefix []rune) bool {
 	return runes.Equal(r[:len(prefix)], prefix)
 }
 
+// HasPrefixEx reports whether r begins with prefix, ignoring the case if fold
+func (rs Runes) HasPrefixEx(r, prefix []rune, fold bool) bool {
+	if fold {
+		return rs.HasPrefixFold(r, prefix)
+	}
+	return rs.HasPrefix(r, prefix)
+}
+
+func (Runes) HasSuffixFold(r, suffix []rune) bool {
+	if len(r) < len(suffix) {
+		return false
+	}
+	return runes.EqualFold(r[len(r)-len(suffix):], suffix)
+}
+
+func (Runes) HasSuffix(r, suffix []rune) bool {
+	if len(r) < len(suffix) {
+		return false
+	}
+	return runes.Equal(r[len(r)-len(suffix):], suffix)
+}
+
+// HasSuffixEx reports whether r ends with suffix, ignoring the case if fold
+func (rs Runes) HasSuffixEx(r, suffix []rune, fold bool) bool {
+	if fold {
+		return rs.HasSuffixFold(r, suffix)
+	}
+	return rs.HasSuffix(r, suffix)
+}
+
 func (Runes) Aggregate(candicate [][]rune) (same []rune, size int) {
 	for i := 0; i < len(candicate[0]); i++ {
 		for j := 0; j < len(candicate)-1; j++ {
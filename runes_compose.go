@@ -0,0 +1,30 @@
+package readline
+
+import (
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Compose returns r in the NFC form, the combining marks are reordered and
+// composed with their letters. pos is the index in r of each rune returned.
+func (Runes) Compose(r []rune) (ret []rune, pos []int) {
+	s := string(r)
+	ret = make([]rune, 0, len(r))
+	pos = make([]int, 0, len(r))
+	var it norm.Iter
+	it.InitString(norm.NFC, s)
+	// the runes of a segment all map to where it starts in r
+	for i, start := 0, 0; !it.Done(); {
+		seg := it.Next()
+		for len(seg) > 0 {
+			c, size := utf8.DecodeRune(seg)
+			ret = append(ret, c)
+			pos = append(pos, i)
+			seg = seg[size:]
+		}
+		i += utf8.RuneCountInString(s[start:it.Pos()])
+		start = it.Pos()
+	}
+	return ret, pos
+}
@@ -66,3 +66,51 @@ func TestAggRunes(t *testing.T) {
 		}
 	}
 }
+
+func TestIndexAllOccurrences(t *testing.T) {
+	rs := []struct {
+		r, sub string
+		fold   bool
+		e      []int
+	}{
+		{"aaa", "aa", false, []int{0}},
+		{"git add; GIT push", "git", true, []int{0, 9}},
+		{"git add; GIT push", "git", false, []int{0}},
+		{"ls", "x", false, nil},
+	}
+	for _, r := range rs {
+		if idx := runes.IndexAllOccurrences([]rune(r.r), []rune(r.sub), r.fold); !reflect.DeepEqual(idx, r.e) {
+			t.Fatal("result not expect", r.r, r.sub, idx)
+		}
+	}
+}
+
+func TestHasPrefixSuffix(t *testing.T) {
+	rs := []struct {
+		r, x           string
+		fold           bool
+		prefix, suffix bool
+	}{
+		{"git push", "git", false, true, false},
+		{"git push", "push", false, false, true},
+		{"GIT PUSH", "git", false, false, false},
+		{"GIT PUSH", "git", true, true, false},
+		{"GIT PUSH", "push", true, false, true},
+		{"日本語", "日本", false, true, false},
+		{"日本語", "本語", false, false, true},
+		{"ÉCOLE", "éc", true, true, false},
+		{"ÉCOLE", "éc", false, false, false},
+		{"café", "FÉ", true, false, true},
+		{"café", "FÉ", false, false, false},
+		{"ls", "", false, true, true},
+		{"ls", "lss", true, false, false},
+	}
+	for _, r := range rs {
+		if ok := runes.HasPrefixEx([]rune(r.r), []rune(r.x), r.fold); ok != r.prefix {
+			t.Fatal("prefix not expect", r.r, r.x, ok)
+		}
+		if ok := runes.HasSuffixEx([]rune(r.r), []rune(r.x), r.fold); ok != r.suffix {
+			t.Fatal("suffix not expect", r.r, r.x, ok)
+		}
+	}
+}
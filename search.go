@@ -2,7 +2,6 @@ package readline
 
 import (
 	"bytes"
-	"container/list"
 	"fmt"
 	"io"
 )
@@ -21,7 +20,6 @@ type opSearch struct {
 	inMode    bool
 	state     int
 	dir       int
-	source    *list.Element
 	w         io.Writer
 	buf       *RuneBuffer
 	data      []rune
@@ -30,6 +28,11 @@ type opSearch struct {
 	markStart int
 	markEnd   int
 	width     int
+
+	// where history and the buffer are before searching, for cancelling it
+	source    historyCursor
+	sourceBuf []rune
+	sourceIdx int
 }
 
 func newOpSearch(w io.Writer, buf *RuneBuffer, history *opHistory, cfg *Config, width int) *opSearch {
@@ -57,11 +60,8 @@ func (o *opSearch) SearchBackspace() {
 	}
 }
 
-func (o *opSearch) findHistoryBy(isNewSearch bool) (int, *list.Element) {
-	if o.dir == S_DIR_BCK {
-		return o.history.FindBck(isNewSearch, o.data, o.buf.idx)
-	}
-	return o.history.FindFwd(isNewSearch, o.data, o.buf.idx)
+func (o *opSearch) findHistoryBy(isNewSearch bool) (int, []rune, bool) {
+	return o.history.findAndMove(o.dir == S_DIR_BCK, isNewSearch, o.data, o.buf.idx)
 }
 
 func (o *opSearch) search(isChange bool) bool {
@@ -70,14 +70,12 @@ func (o *opSearch) search(isChange bool) bool {
 		o.SearchRefresh(-1)
 		return true
 	}
-	idx, elem := o.findHistoryBy(isChange)
-	if elem == nil {
+	idx, item, ok := o.findHistoryBy(isChange)
+	if !ok {
 		o.SearchRefresh(-2)
 		return false
 	}
-	o.history.current = elem
 
-	item := o.history.showItem(o.history.current.Value)
 	start, end := 0, 0
 	if o.dir == S_DIR_BCK {
 		start, end = idx, idx+len(o.data)
@@ -91,6 +89,16 @@ func (o *opSearch) search(isChange bool) bool {
 	return true
 }
 
+// Matches returns the span of each match of the searching keyword in the
+// found item, as the start and end index of the runes, SearchRefresh underlines
+// them all.
+func (o *opSearch) Matches() [][2]int {
+	if !o.inMode || o.state != S_STATE_FOUND || len(o.data) == 0 {
+		return nil
+	}
+	return o.history.currentMatches(o.data)
+}
+
 func (o *opSearch) SearchChar(r rune) {
 	o.data = append(o.data, r)
 	o.search(true)
@@ -101,12 +109,18 @@ func (o *opSearch) SearchMode(dir int) bool {
 		return false
 	}
 	alreadyInMode := o.inMode
+	if !alreadyInMode && o.cfg.HistoryReloadOnSearch {
+		// ignore IO error
+		_ = o.history.Reload()
+	}
 	o.inMode = true
 	o.dir = dir
-	o.source = o.history.current
 	if alreadyInMode {
 		o.search(false)
 	} else {
+		o.source = o.history.snapshotCursor()
+		o.sourceBuf = runes.Copy(o.buf.Runes())
+		o.sourceIdx = o.buf.idx
 		o.SearchRefresh(-1)
 	}
 	return true
@@ -114,13 +128,14 @@ func (o *opSearch) SearchMode(dir int) bool {
 
 func (o *opSearch) ExitSearchMode(revert bool) {
 	if revert {
-		o.history.current = o.source
-		o.buf.Set(o.history.showItem(o.history.current.Value))
+		o.history.restoreCursor(o.source)
+		o.buf.SetWithIdx(o.sourceIdx, o.sourceBuf)
 	}
 	o.markStart, o.markEnd = 0, 0
 	o.state = S_STATE_FOUND
 	o.inMode = false
-	o.source = nil
+	o.source = historyCursor{}
+	o.sourceBuf = nil
 	o.data = nil
 }
 
@@ -137,7 +152,10 @@ func (o *opSearch) SearchRefresh(x int) {
 	x += o.buf.PromptLen()
 	x = x % o.width
 
-	if o.markStart > 0 {
+	// underline every match in the found item, not only the one found
+	if spans := o.Matches(); len(spans) > 0 {
+		o.buf.SetStyles(spans, "4")
+	} else if o.markStart > 0 {
 		o.buf.SetStyle(o.markStart, o.markEnd, "4")
 	}
 
@@ -35,6 +35,8 @@ func NewTerminal(cfg *Config) (*Terminal, error) {
 		sizeChan: make(chan string, 1),
 	}
 
+	// added before Close may wait for it
+	t.wg.Add(1)
 	go t.ioloop()
 	return t, nil
 }
@@ -104,6 +106,20 @@ func (t *Terminal) ReadRune() rune {
 	return ch
 }
 
+// readRuneOr is like ReadRune, but it gives up and returns false once cancel
+// is received
+func (t *Terminal) readRuneOr(cancel <-chan struct{}) (rune, bool) {
+	select {
+	case ch, ok := <-t.outchan:
+		if !ok {
+			return rune(0), true
+		}
+		return ch, true
+	case <-cancel:
+		return rune(0), false
+	}
+}
+
 func (t *Terminal) IsReading() bool {
 	return atomic.LoadInt32(&t.isReading) == 1
 }
@@ -116,7 +132,6 @@ func (t *Terminal) KickRead() {
 }
 
 func (t *Terminal) ioloop() {
-	t.wg.Add(1)
 	defer func() {
 		t.wg.Done()
 		close(t.outchan)
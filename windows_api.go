@@ -22,6 +22,8 @@ type Kernel struct {
 	ReadConsoleInputW,
 	GetConsoleScreenBufferInfo,
 	GetConsoleCursorInfo,
+	LockFileEx,
+	UnlockFileEx,
 	GetStdHandle CallFunc
 }
 